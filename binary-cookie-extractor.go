@@ -6,13 +6,49 @@
   program will decode them and print them out.
 
   Usage:
-  $ ./binary-cookie-extractor -i <BINARY-COOKIE-FILE> [-f table|list|json|csv|xml] [-d]
+  $ ./binary-cookie-extractor -i <BINARY-COOKIE-FILE> | -backup <DIR> | -hex <HEX> [-f table|compact-table|list|json|csv|tsv|xml|anomalies|tree|histogram|plist|apple-cookies-plist|count-by-flag|single|keyvalue|ini|meta|influx|domains|pb|xlsx] [-json-keys camel|snake] [-limit N] [-max-value-len N] [-session-label TEXT] [-truncate N|auto] [-relative-time] [-raw-time] [-retention] [-stats-per-file] [-d]
 
   Examples:
   $ ./binary-cookie-extractor -i Cookie.binarycookies
   $ ./binary-cookie-extractor -i Cookie.binarycookies -f list
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f compact-table
   $ ./binary-cookie-extractor -i Cookie.binarycookies -f json
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f json -json-keys snake
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f json -wrap
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f tsv
   $ ./binary-cookie-extractor -i Cookie.binarycookies -f xml
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f plist
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f apple-cookies-plist
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f count-by-flag
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -retention
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -retention -f json
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f meta
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f influx
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f pb -o cookies.pb
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f xlsx -o cookies.xlsx
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f keyvalue -domain example.com -prefix EXAMPLE_
+  $ TOKEN=$(./binary-cookie-extractor -i Cookie.binarycookies -f single -domain example.com)
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f anomalies -max-value-len 256
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -sort expires -reverse -limit 10
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -recent 5
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f tree
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f ini
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f domains -normalize-domains
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f histogram -bucket year
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -f json -split-by domain -o cookies/
+  $ ./binary-cookie-extractor -backup ~/Backups/00008030-001A2B3C4D5E6F70 -f json -o cookies.json.gz
+  $ ./binary-cookie-extractor -i https://example.com/Cookies.binarycookies -timeout 10s
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -dump-at 0x100:64
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -header-only
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -watch
+  $ ./binary-cookie-extractor -i Cookie.binarycookies -template '{{.Name}} -> {{.Value}} ({{.Domain}})'
+  $ ./binary-cookie-extractor -hex '63 6f 6f 6b 00 00 00 01 ...'
+  $ xxd -p Cookie.binarycookies | ./binary-cookie-extractor -hex -
+  $ base64 Cookie.binarycookies | ./binary-cookie-extractor -base64 -i -
+  $ ./binary-cookie-extractor -backup ~/Backups/00008030-001A2B3C4D5E6F70 -f csv
+  $ ./binary-cookie-extractor -backup ~/Backups/00008030-001A2B3C4D5E6F70 -stats-per-file
+  $ ./binary-cookie-extractor -backup ~/Backups -merge newest -f json
+  $ ./binary-cookie-extractor -backup ~/Backups/00008030-001A2B3C4D5E6F70 -search abc123 -ignore-case
 
   Created by @KittyNighthawk (2021) (https://github.com/KittyNighthawk)
 */
@@ -20,428 +56,3449 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	runtimedebug "runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/KittyNighthawk/binary-cookie-extractor/binarycookies"
 )
 
-type pages struct {
-	pages      []page
-	numPages   uint64
-	pageSizes  []uint64
-	headerSize uint64
+type cookie struct {
+	rawBytes            []byte
+	expiresTime         time.Time
+	lastAccessedTime    time.Time
+	page                int
+	number              int
+	offset              int
+	ID                  string   `json:"id,omitempty" xml:"-"`
+	Size                uint64   `json:"size" xml:"Size"`
+	Name                string   `json:"name" xml:"Name"`
+	Value               string   `json:"value" xml:"Value"`
+	ValueEntropy        *float64 `json:"valueEntropy,omitempty" xml:"-"`
+	NameLen             *int     `json:"nameLen,omitempty" xml:"-"`
+	ValueLen            *int     `json:"valueLen,omitempty" xml:"-"`
+	Domain              string   `json:"domain" xml:"Domain"`
+	RawDomain           string   `json:"rawDomain,omitempty" xml:"-"`
+	RawName             string   `json:"rawName,omitempty" xml:"-"`
+	RawValue            string   `json:"rawValue,omitempty" xml:"-"`
+	Path                string   `json:"path" xml:"Path"`
+	Flags               string   `json:"flags" xml:"Flags"`
+	FlagsRaw            string   `json:"flagsRaw,omitempty" xml:"-"`
+	Expires             string   `json:"expires" xml:"Expires"`
+	ExpiresRaw          *float64 `json:"expiresRaw,omitempty" xml:"-"`
+	ExpiresMacTime      *int64   `json:"expiresMacTime,omitempty" xml:"-"`
+	LastAccessed        string   `json:"lastAccessed" xml:"LastAccessed"`
+	CreationRaw         *float64 `json:"creationRaw,omitempty" xml:"-"`
+	LastAccessedMacTime *int64   `json:"lastAccessedMacTime,omitempty" xml:"-"`
+	ExpiresWeek         string   `json:"expiresWeek,omitempty" xml:"-"`
+	CreationWeek        string   `json:"creationWeek,omitempty" xml:"-"`
+	Session             bool     `json:"session,omitempty" xml:"Session,omitempty"`
+	Deleted             bool     `json:"deleted,omitempty" xml:"-"`
+	NameEncoding        string   `json:"nameEncoding,omitempty" xml:"-"`
+	ValueEncoding       string   `json:"valueEncoding,omitempty" xml:"-"`
+	Source              string   `json:"source,omitempty" xml:"Source,omitempty"`
+	Warnings            []string `json:"warnings,omitempty" xml:"-"`
+}
+
+// The output formats that can be given to -f
+var formats = []string{"table", "compact-table", "list", "json", "csv", "tsv", "xml", "anomalies", "tree", "histogram", "plist", "apple-cookies-plist", "count-by-flag", "single", "keyvalue", "ini", "meta", "influx", "domains", "pb", "xlsx"}
+
+// Command line flag variables
+var file = flag.String("i", "", "path to the binary cookies file")
+var hexInput = flag.String("hex", "", "decode binary cookies given as a hex string instead of a file (- reads the hex from stdin)")
+var base64Input = flag.Bool("base64", false, "the -i file (or stdin, with -i -) is base64 encoded, e.g. copied out of a JSON report")
+var offset = flag.String("offset", "", "decode the binary cookies starting N bytes into the -i file, e.g. when carving from a disk image (decimal or 0x hex)")
+var length = flag.String("length", "", "with -offset, only decode the M bytes from the offset (decimal or 0x hex)")
+var dumpAt = flag.String("dump-at", "", "print a hex dump of LEN bytes of the file from OFFSET and exit (OFFSET:LEN)")
+var headerOnly = flag.Bool("header-only", false, "check and print the file header (magic, page count, and page sizes) without decoding any pages")
+var split = flag.Bool("split", false, "decode every binary cookies blob in a file made of several concatenated together")
+var timeout = flag.Duration("timeout", 30*time.Second, "how long to wait when -i is an http(s) URL")
+var backup = flag.String("backup", "", "path to a directory (e.g. an iOS backup) to search for binary cookies files")
+var dumpFlags = flag.Bool("dump-flags", false, "print every flag as JSON (for generating completions and docs) and exit")
+var magic = flag.String("magic", "cook", "the 4 byte signature files must start with, for experimenting with variant formats")
+var pageSizeHeader = flag.String("page-size-includes-header", "auto", "whether the page sizes in the header include each page's 4 byte header [auto|yes|no]")
+var version = flag.Bool("v", false, "display version number")
+var debug = flag.Bool("d", false, "display debugging information")
+var format = flag.String("f", "table", "format of output ["+strings.Join(formats, "|")+"]")
+var maxValueLen = flag.Int("max-value-len", 0, "flag cookies with values longer than N bytes in anomalies output (0 disables)")
+var sortBy = flag.String("sort", "", "sort the cookies by a field [name|domain|path|expires|creation]")
+var reverse = flag.Bool("reverse", false, "reverse the order given with -sort")
+var recent = flag.Int("recent", 0, "only output the N most recently created cookies (shortcut for -sort creation -reverse -limit N)")
+var canonical = flag.Bool("canonical", false, "output the cookies ordered by domain, path, name, and value, for reproducible diffs (overrides -sort)")
+var merge = flag.String("merge", "", "keep one cookie for each domain, path, and name, e.g. across the files of -backup [newest]")
+var allowDomains = flag.String("allow-domains", "", "only output the cookies for domains matching a pattern in this file (one per line)")
+var denyDomains = flag.String("deny-domains", "", "don't output the cookies for domains matching a pattern in this file (one per line), even if they are allowed")
+var domainFilter = flag.String("domain", "", "only output the cookies for this domain (ignoring case and a leading dot)")
+var requireCookies = flag.Bool("require-cookies", false, "exit with an error if there are no cookies to output")
+var retention = flag.Bool("retention", false, "count the cookies by how long they have left before they expire, instead of outputting them (as a table, or a JSON object with -f json)")
+var statsPerFile = flag.Bool("stats-per-file", false, "describe each file processed (its cookie and page counts, and whether it decoded cleanly) instead of outputting the cookies (as a table, or a JSON array with -f json)")
+var search = flag.String("search", "", "print where TEXT appears in any cookie's name, value, domain, or path, instead of the cookies")
+var valueContains = flag.String("value-contains", "", "only output the cookies whose value contains this text (e.g. a known user ID)")
+var ignoreCase = flag.Bool("ignore-case", false, "make -search and -value-contains case-insensitive")
+var tail = flag.Int("tail", 0, "only output the last N cookies in the file (picked before -sort is applied)")
+var limit = flag.Int("limit", 0, "maximum number of cookies to output (0 or less means unlimited)")
+var sessionLabel = flag.String("session-label", "session", "text shown in place of the expiry for session cookies")
+var detectUTF16 = flag.Bool("detect-utf16", false, "decode cookie values that look like UTF-16 (e.g. from Windows-synced sources) instead of cutting them off at the first null byte")
+var strictUTF8 = flag.Bool("strict-utf8", false, "exit with an error if any cookie's name, value, domain, or path isn't valid UTF-8")
+var withID = flag.Bool("with-id", false, "include an ID for each cookie (a hash of its domain, path, and name) in JSON and CSV output, for matching cookies across exports")
+var withEntropy = flag.Bool("with-entropy", false, "include the Shannon entropy of each cookie's value (in bits per byte) in JSON and CSV output")
+var minEntropy = flag.Float64("min-entropy", 0, "only output the cookies whose value has at least this much Shannon entropy, in bits per byte (e.g. 4 for likely tokens)")
+var withLengths = flag.Bool("with-lengths", false, "include the length in bytes of each cookie's name and value in JSON and CSV output")
+var isoWeek = flag.Bool("iso-week", false, "include the ISO week of the expiry and creation dates in JSON output (e.g. 2021-W03)")
+var rawFlags = flag.Bool("raw-flags", false, "include the flags as stored in the file, in hex, in JSON and CSV output")
+var rawTime = flag.Bool("raw-time", false, "include the raw Core Data timestamps in JSON and CSV output")
+var macTime = flag.Bool("mac-time", false, "include the timestamps as whole seconds since 2001-01-01 (Mac absolute time) in JSON and CSV output")
+var bucket = flag.String("bucket", "month", "size of the buckets in histogram output [month|year]")
+var normalizeDomains = flag.Bool("normalize-domains", false, "lowercase domains and strip a single leading dot")
+var urlDecode = flag.Bool("url-decode", false, "percent-decode cookie values before output")
+var urlDecodeNames = flag.Bool("url-decode-names", false, "percent-decode cookie names before output")
+var withRaw = flag.Bool("with-raw", false, "keep the original values/names in JSON output when they are percent-decoded")
+var splitDatetime = flag.Bool("split-datetime", false, "put the date and time of each timestamp in separate CSV columns")
+var timezone = flag.String("timezone", "local", "timezone of the -split-datetime columns [local|UTC|an IANA name like Europe/London]")
+var excel = flag.Bool("excel", false, "write CSV output with a UTF-8 BOM and CRLF line endings, for Excel")
+var csvFooter = flag.Bool("csv-footer", false, "end CSV output with a \"# rows: N\" line giving the number of cookies")
+var outputPath = flag.String("o", "", "path to write the output to instead of stdout (a directory when -split-by is used)")
+var splitBy = flag.String("split-by", "", "write one output file per group into the -o directory [domain]")
+var gzipOutput = flag.Bool("gzip", false, "gzip compress the output (done automatically when the -o file ends in .gz)")
+var expandJSONValues = flag.Bool("expand-json-values", false, "show cookie values that are JSON as indented/nested JSON in list and JSON output")
+var colorMode = flag.String("color", "auto", "color table output [auto|always|never]")
+var watch = flag.Bool("watch", false, "keep running, decoding the -i file again and outputting its cookies whenever it changes (Ctrl-C to stop)")
+var pageOutput = flag.Bool("page-output", false, "show table and list output in $PAGER (default less -R) when printing to a terminal")
+var relativeTime = flag.Bool("relative-time", false, "show expiry and creation times relative to now (e.g. in 3d, 2y ago) in table and list output")
+var truncate = flag.String("truncate", "", "cap values in table and list output at N characters, or the terminal width with auto")
+var wrapJSON = flag.Bool("wrap", false, "wrap JSON output in an object holding the cookies and any parse warnings")
+var selfTest = flag.Bool("selftest", false, "decode the file, encode the cookies again, decode that, and check the cookies are the same")
+var epoch = flag.String("epoch", "coredata", "epoch of the timestamps, for third-party files that use unix time [coredata|unix]")
+var templateText = flag.String("template", "", "write each cookie with this Go text/template instead of a -f format (e.g. '{{.Name}} -> {{.Value}}')")
+var templateFile = flag.String("template-file", "", "like -template, but read the template from this file")
+var keyPrefix = flag.String("prefix", "", "text put in front of each name in keyvalue output")
+var renameFields = flag.String("rename-fields", "", "rename fields in JSON and CSV output, given as FIELD=NEW,... (e.g. name=cookie_name,domain=host)")
+var jsonKeys = flag.String("json-keys", "camel", "style of the keys in JSON output [camel|snake]")
+
+func main() {
+	parseComLineFlags()
+
+	// Watching runs the decode again as a new process for each change, so nothing (e.g. warnings) carries over
+	if *watch {
+		handleError(runWatch())
+		return
+	}
+
+	// These variables will hold all the decoded cookies, and the warnings found while parsing them, for later use
+	var allCookies []cookie
+	var warnings []string
+
+	// The per-file stats describe each file processed rather than the cookies, so they are written straight from the files
+	if *statsPerFile {
+		handleError(writeFileStats())
+		return
+	}
+
+	if *backup != "" {
+		// In backup mode every binary cookies file found in the directory is decoded, each tagged with its source path
+		filter, err := newJarFilter()
+		handleError(err)
+		allCookies, warnings, err = decodeBackupDirectory(*backup, filter)
+		handleError(err)
+	} else {
+		data, err := readInputData()
+		handleError(err)
+
+		// Dumping raw bytes is a diagnostic aid for bug reports, so nothing is decoded
+		if *dumpAt != "" {
+			handleError(dumpBytes(os.Stdout, data, *dumpAt))
+			return
+		}
+
+		// Checking the header is for quick integrity sweeps over many files, so the pages are never looked at
+		if *headerOnly {
+			handleError(printHeader(os.Stdout, data))
+			return
+		}
+
+		// The self-test checks this file decodes losslessly, so the cookies themselves aren't output
+		if *selfTest {
+			handleError(runSelfTest(os.Stdout, data))
+			return
+		}
+
+		// Meta output describes the layout of the file rather than the cookies in it, so it is written straight from the pages
+		if *format == "meta" {
+			handleError(writeMeta(data))
+			return
+		}
+
+		filter, err := newJarFilter()
+		handleError(err)
+		if *split {
+			// Each blob in a concatenated file is parsed on its own, and the cookies from all of them output together
+			segments := splitConcatenated(data)
+			for i, segment := range segments {
+				if *debug {
+					debugf("Decoding blob %d of %d (%d bytes)\n", i+1, len(segments), len(segment))
+				}
+				cookies, segmentWarnings, err := decodeJar(segment, "", filter)
+				handleError(err)
+				allCookies = append(allCookies, cookies...)
+				warnings = append(warnings, segmentWarnings...)
+			}
+		} else {
+			allCookies, warnings, err = decodeJar(data, "", filter)
+			handleError(err)
+		}
+	}
+
+	// The summary is of the cookies as decoded, before anything below changes or drops them
+	var stats decodeStats
+	if *debug {
+		debugNonASCIIDomains(allCookies)
+		stats = buildDecodeStats(allCookies)
+	}
+
+	// Searching reports where the text was found rather than outputting cookies, so none of the formats apply
+	if *search != "" {
+		handleError(printSearchResults(os.Stdout, allCookies, *search))
+		return
+	}
+
+	// Normalizing happens before anything else looks at the domains, so grouping treats .Example.com and example.com alike
+	if *normalizeDomains {
+		normalizeCookieDomains(allCookies)
+	}
+
+	if *urlDecode || *urlDecodeNames {
+		urlDecodeCookies(allCookies)
+	}
+
+	// Merging compares domains, so it comes after they are normalized (letting .Example.com and example.com match)
+	if *merge == "newest" {
+		allCookies = mergeNewest(allCookies)
+	}
+
+	if *minEntropy > 0 {
+		allCookies = filterByEntropy(allCookies, *minEntropy)
+	}
+
+	if *valueContains != "" {
+		allCookies = filterByValue(allCookies, *valueContains, *ignoreCase)
+	}
+
+	// The last cookies are picked in file order, so -tail always means the physically last cookies however they are sorted
+	allCookies = tailCookies(allCookies, *tail)
+
+	// Sort the cookies if asked, -recent being shorthand for the newest cookies first, then cap how many are output
+	sortKey, descending, n := *sortBy, *reverse, *limit
+	if *recent > 0 {
+		sortKey, descending, n = "creation", true, *recent
+	}
+	if sortKey != "" {
+		sortCookies(allCookies, sortKey, descending)
+	}
+	allCookies = limitCookies(allCookies, n)
+
+	// The canonical order is applied last, so the output only depends on which cookies were picked, not the order they
+	// were read in or sorted into
+	if *canonical {
+		canonicalSortCookies(allCookies)
+	}
+
+	// An empty result is normally fine (e.g. a freshly created cache), but pipelines can ask for it to be treated as a failure
+	if *requireCookies && len(allCookies) == 0 {
+		handleError(errors.New("no cookies were found (after any filters were applied)"))
+	}
+
+	if *isoWeek && *format == "json" {
+		addISOWeeks(allCookies)
+	}
+
+	// The entropy is of the value as decoded, so it is worked out before any base64 encoding for output
+	if *withID {
+		addCookieIDs(allCookies)
+	}
+	if *withEntropy {
+		addValueEntropy(allCookies)
+	}
+
+	if *strictUTF8 {
+		handleError(checkStrictUTF8(allCookies))
+	}
+
+	// JSON, CSV, and protobuf consumers expect valid UTF-8, so names/values holding raw binary are base64 encoded for those formats
+	if *format == "json" || *format == "csv" || *format == "tsv" || *format == "pb" {
+		encodeInvalidUTF8(allCookies)
+	}
+
+	// Based on the format, output the cookie data. The writers return any error rather than exiting, so main decides
+	var err error
+	if *splitBy != "" {
+		err = writeSplitOutput(*outputPath, allCookies, warnings)
+	} else if *outputPath == "" && *pageOutput && (*format == "table" || *format == "compact-table" || *format == "list") && isTerminal(os.Stdout) {
+		err = writePagedOutput(allCookies)
+	} else {
+		err = writeOutputFile(*outputPath, allCookies, warnings)
+	}
+	handleError(err)
+
+	if *debug {
+		stats.print(os.Stderr)
+	}
+}
+
+// This function writes the cookies (and with -wrap, the warnings) in the format given with -f to the file at path, or
+// stdout if path is empty
+func writeOutputFile(path string, cookies []cookie, warnings []string) error {
+	return writeToOutput(path, func(w io.Writer) error { return writeOutput(w, cookies, warnings) })
+}
+
+// This function writes any output (cookies, meta, or per-file stats) by calling write, to the file at path or stdout if
+// path is empty. It is gzip compressed with -gzip, or when path ends in .gz. A file is written to a temporary file in the
+// same directory, which is only renamed to path once it has been written in full, so an error part way through never
+// leaves a half written file at path (the temporary file is removed instead)
+func writeToOutput(path string, write func(w io.Writer) error) error {
+	if *gzipOutput || strings.HasSuffix(path, ".gz") {
+		write = gzipped(write)
+	}
+	if path == "" {
+		return write(os.Stdout)
+	}
+	return writeFileAtomically(path, write)
+}
+
+// This function returns a writer function that gzip compresses what write writes. The gzip writer is closed before it
+// returns, as the end of the compressed stream is only written then
+func gzipped(write func(w io.Writer) error) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		if err := write(zw); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	}
+}
+
+// This function does the work of writeToOutput for a file, written by calling write with the temporary file
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeOutputTemp(f, write); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// This function writes the cookies to the temporary file f. Temporary files are only readable by their owner, so f is
+// given the usual permissions for an output file first
+func writeOutputTemp(f *os.File, write func(w io.Writer) error) error {
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	return write(f)
+}
+
+// This function writes one file per domain into dir (e.g. example.com.json), each containing only that domain's cookies
+// in the format given with -f. Domains that sanitize to the same filename (like .Example.com and example.com) share a file
+func writeSplitOutput(dir string, cookies []cookie, warnings []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Group the cookies by filename, keeping the order each filename was first seen in
+	var names []string
+	byName := make(map[string][]cookie)
+	for i := 0; i < len(cookies); i++ {
+		name := sanitizeFilename(cookies[i].Domain) + "." + formatExtension(*format)
+		if *gzipOutput {
+			name += ".gz"
+		}
+		if _, seen := byName[name]; !seen {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], cookies[i])
+	}
+
+	for _, name := range names {
+		if *debug {
+			debugf("Writing %d cookies to %s\n", len(byName[name]), filepath.Join(dir, name))
+		}
+		if err := writeOutputFile(filepath.Join(dir, name), byName[name], warnings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function makes a domain safe to use as a filename on any platform. It is lowercased (domains are case-insensitive,
+// and so are the default macOS and Windows filesystems), anything other than letters, digits, dots, hyphens, and
+// underscores is replaced with an underscore, and leading dots are removed so the file isn't hidden
+func sanitizeFilename(domain string) string {
+	var result []rune
+	for _, r := range strings.TrimLeft(strings.ToLower(domain), ".") {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_') {
+			result = append(result, r)
+		} else {
+			result = append(result, '_')
+		}
+	}
+	if len(result) == 0 {
+		return "_"
+	}
+	return string(result)
+}
+
+// This function returns the file extension to use for files written in the given output format
+func formatExtension(f string) string {
+	switch f {
+	case "json", "csv", "tsv", "xml", "plist", "ini", "pb", "xlsx":
+		return f
+	case "apple-cookies-plist":
+		return "plist"
+	default:
+		return "txt"
+	}
+}
+
+// This function writes the cookies to w in the format given with -f. warnings are the warnings found while parsing the
+// files the cookies came from, which are output with -wrap
+func writeOutput(w io.Writer, cookies []cookie, warnings []string) error {
+	if outputTemplate != nil {
+		return outputAsTemplate(w, cookies)
+	}
+
+	// A retention report counts the cookies instead of listing them, as a table or (with -f json) a JSON object
+	if *retention {
+		if *format == "json" {
+			return outputAsRetentionJSON(w, cookies)
+		}
+		return outputAsRetention(w, cookies)
+	}
+
+	switch *format {
+	case "table":
+		return outputAsTable(w, cookies)
+	case "compact-table":
+		return outputAsCompactTable(w, cookies)
+	case "list":
+		return outputAsList(w, cookies)
+	case "json":
+		if *wrapJSON {
+			return outputAsWrappedJSON(w, cookies, warnings)
+		}
+		return outputAsJSON(w, cookies)
+	case "csv":
+		return outputAsCSV(w, cookies)
+	case "tsv":
+		return outputAsTSV(w, cookies)
+	case "xml":
+		return outputAsXML(w, cookies)
+	case "anomalies":
+		return outputAsAnomalies(w, cookies)
+	case "tree":
+		return outputAsTree(w, cookies)
+	case "histogram":
+		return outputAsHistogram(w, cookies)
+	case "plist":
+		return outputAsPlist(w, cookies)
+	case "apple-cookies-plist":
+		return outputAsAppleCookiesPlist(w, cookies)
+	case "count-by-flag":
+		return outputAsCountByFlag(w, cookies)
+	case "keyvalue":
+		return outputAsKeyValue(w, cookies)
+	case "single":
+		return outputAsSingle(w, cookies)
+	case "ini":
+		return outputAsINI(w, cookies)
+	case "influx":
+		return outputAsInflux(w, cookies)
+	case "domains":
+		return outputAsDomains(w, cookies)
+	case "pb":
+		return outputAsProtobuf(w, cookies)
+	case "xlsx":
+		return outputAsXLSX(w, cookies)
+	default:
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+}
+
+// This function returns a decoder for the binary cookies files given to this run, set up by -magic,
+// -page-size-includes-header, -epoch, and -detect-utf16. Warnings are printed to stderr as they are found, and with -d so
+// is each step of decoding
+func newDecoder() *binarycookies.Decoder {
+	decoder := quietDecoder()
+	decoder.Warn = printWarning
+	if *debug {
+		decoder.Debugf, decoder.Event = debugf, debugEvent
+	}
+	return decoder
+}
+
+// This function returns a decoder set up like newDecoder's that doesn't print anything, for reading the headers of files
+// that are decoded again afterwards (so -d doesn't show the same header twice)
+func quietDecoder() *binarycookies.Decoder {
+	return &binarycookies.Decoder{
+		Magic:                  *magic,
+		PageSizeIncludesHeader: *pageSizeHeader,
+		UnixEpoch:              *epoch == "unix",
+		DetectUTF16:            *detectUTF16,
+	}
+}
+
+// This function takes the contents of a binary cookies file and returns the decoded cookies it contains, in file order.
+// Unlike main, it never exits the process: an invalid file is reported by returning an error, so it can be called from
+// benchmarks and tests
+func parseCookies(data []byte) ([]cookie, error) {
+	decoded, err := newDecoder().Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return newCookies(decoded), nil
+}
+
+// This function decodes the binary cookies file in data like parseCookies, but also returns the layout of the file (its
+// pages, their sizes, and the footer), for meta and -stats-per-file output
+func parseWithInfo(data []byte) (binarycookies.FileInfo, []cookie, error) {
+	info, decoded, err := newDecoder().ParseWithInfo(bytes.NewReader(data))
+	if err != nil {
+		return info, nil, err
+	}
+	return info, newCookies(decoded), nil
+}
+
+// This function decodes the binary cookies file in data into a jar, and returns the cookies filter keeps for output, each
+// with its Source set to source (the file it came from, with -backup), and the warnings found while parsing it. With
+// -backup each warning starts with the file it was found in
+func decodeJar(data []byte, source string, filter *jarFilter) ([]cookie, []string, error) {
+	j, err := newDecoder().ParseJar(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	cookies := newCookies(filter.apply(j))
+	for i := 0; i < len(cookies); i++ {
+		cookies[i].Source = source
+	}
+	var warnings []string
+	for _, w := range j.Info.Warnings {
+		if source != "" {
+			warnings = append(warnings, source+": "+w.Msg)
+		} else {
+			warnings = append(warnings, w.Msg)
+		}
+	}
+	return cookies, warnings, nil
+}
+
+// This function turns the cookies decoded from a file into cookies for output
+func newCookies(decoded []binarycookies.Cookie) []cookie {
+	var cookies []cookie
+	for i := 0; i < len(decoded); i++ {
+		cookies = append(cookies, newCookie(decoded[i]))
+	}
+	return cookies
+}
+
+// This function turns a decoded cookie into a cookie for output, formatting its flags and times and filling in the fields
+// asked for with -raw-flags, -with-lengths, -mac-time, and -raw-time
+func newCookie(c binarycookies.Cookie) cookie {
+	aCookie := cookie{
+		rawBytes:         c.Raw,
+		page:             c.Page,
+		number:           c.Number,
+		offset:           c.Offset,
+		expiresTime:      c.Expires,
+		lastAccessedTime: c.Created,
+		Size:             c.Size,
+		Name:             c.Name,
+		Value:            c.Value,
+		Domain:           c.Domain,
+		Path:             c.Path,
+		Flags:            c.FlagText(),
+		Expires:          convertExpiryToString(c),
+		LastAccessed:     convertCoreDataToString(c.Created),
+		Session:          c.Session,
+		Deleted:          c.Deleted,
+		Warnings:         c.Warnings,
+	}
+	// Combinations of bits without a label all show as Unknown, so the bits themselves are kept for researching them
+	if *rawFlags {
+		aCookie.FlagsRaw = fmt.Sprintf("0x%08x", c.Flags)
+	}
+	if *withLengths {
+		nameLen, valueLen := len(c.Name), len(c.Value)
+		aCookie.NameLen = &nameLen
+		aCookie.ValueLen = &valueLen
+	}
+	// Other binary cookies tools output Mac absolute time as whole seconds, so this is truncated the same way
+	if *macTime {
+		expiresMac := int64(c.ExpiresRaw)
+		lastAccessedMac := int64(c.CreatedRaw)
+		aCookie.ExpiresMacTime = &expiresMac
+		aCookie.LastAccessedMacTime = &lastAccessedMac
+	}
+	// The second timestamp is when the cookie was created, so its raw value is CreationRaw, as asked for with -raw-time,
+	// even though the formatted one is output as lastAccessed
+	if *rawTime {
+		expiresCoreData, creationCoreData := c.ExpiresRaw, c.CreatedRaw
+		aCookie.ExpiresRaw = &expiresCoreData
+		aCookie.CreationRaw = &creationCoreData
+	}
+	return aCookie
+}
+
+// Helper method to convert a cookie's expiry time to a string. Session cookies get the -session-label text instead of a
+// date
+func convertExpiryToString(c binarycookies.Cookie) string {
+	if c.Session {
+		return *sessionLabel
+	}
+	return convertCoreDataToString(c.Expires)
+}
+
+// This function writes the meta output for data as JSON, to the -o file if one was given or stdout otherwise
+func writeMeta(data []byte) error {
+	meta, _, err := parseWithInfo(data)
+	if err != nil {
+		return err
+	}
+	write := func(w io.Writer) error {
+		marshalled, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(marshalled))
+		return err
+	}
+	return writeToOutput(*outputPath, write)
+}
+
+// This function returns the contents of the -i input. Local paths are read from disk, while http:// and https:// URLs are
+// fetched into memory (within -timeout), so remote files can be decoded without downloading them first
+func readInput(path string) ([]byte, error) {
+	// Base64 is text, so it is often pasted or piped in rather than saved to a file first
+	if path == "-" && *base64Input {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		return ioutil.ReadFile(path)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("fetching %s failed: %s", path, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// This function reads the binary cookies to decode from -hex or the -i file (decoding it first with -base64), then cuts
+// out the part given by -offset and -length
+func readInputData() ([]byte, error) {
+	var data []byte
+	var err error
+	if *hexInput != "" {
+		data, err = readHexInput(*hexInput)
+	} else {
+		data, err = readInput(*file)
+		if err == nil && *base64Input {
+			data, err = decodeBase64Input(data)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return carveInput(data, *offset, *length)
+}
+
+// This function returns the part of data starting offsetSpec bytes in and running for lengthSpec bytes (or to the end if
+// lengthSpec is empty), for decoding a binary cookies blob embedded in a larger file such as a disk image. Both are
+// checked against the size of data, so a bad offset is reported rather than showing up as a bad magic number
+func carveInput(data []byte, offsetSpec, lengthSpec string) ([]byte, error) {
+	if offsetSpec == "" && lengthSpec == "" {
+		return data, nil
+	}
+
+	var start uint64
+	var err error
+	if offsetSpec != "" {
+		start, err = strconv.ParseUint(offsetSpec, 0, 64)
+		if err != nil {
+			return nil, &binarycookies.ParseError{Offset: -1, Msg: fmt.Sprintf("invalid -offset: %v", err)}
+		}
+	}
+	if start > uint64(len(data)) {
+		return nil, &binarycookies.ParseError{Offset: len(data), Msg: fmt.Sprintf("-offset %d is past the end of the file (%d bytes)", start, len(data))}
+	}
+	end := uint64(len(data))
+	if lengthSpec != "" {
+		size, err := strconv.ParseUint(lengthSpec, 0, 64)
+		if err != nil {
+			return nil, &binarycookies.ParseError{Offset: -1, Msg: fmt.Sprintf("invalid -length: %v", err)}
+		}
+		if size > end-start {
+			return nil, &binarycookies.ParseError{Offset: len(data), Msg: fmt.Sprintf("-length %d from offset %d runs past the end of the file (%d bytes)", size, start, len(data))}
+		}
+		end = start + size
+	}
+
+	if *debug {
+		debugf("Decoding bytes %d to %d of the input\n", start, end)
+	}
+	return data[start:end], nil
+}
+
+// This function decodes base64 encoded input (with or without padding) back into the binary cookies file. Whitespace and
+// line breaks, as found in wrapped base64, are ignored
+func decodeBase64Input(encoded []byte) ([]byte, error) {
+	text := strings.Join(strings.Fields(string(encoded)), "")
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid -base64 input: %v", err)
+	}
+	return data, nil
+}
+
+// This function returns the bytes given as hex with -hex, reading the hex from stdin if it is "-". Whitespace between
+// bytes and 0x prefixes are ignored, so hex copied from other tools (like "63 6f 6f 6b" or "0x63 0x6f") can be pasted in
+func readHexInput(text string) ([]byte, error) {
+	if text == "-" {
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		text = string(stdin)
+	}
+
+	var digits strings.Builder
+	for _, field := range strings.Fields(text) {
+		field = strings.TrimPrefix(strings.TrimPrefix(field, "0x"), "0X")
+		digits.WriteString(field)
+	}
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid -hex input: %v", err)
+	}
+	return data, nil
+}
+
+// This function writes a hex dump of part of data to w. The part is given as OFFSET:LEN (either can be decimal, or hex
+// with a 0x prefix), and is checked against the length of data so a bad range is reported rather than panicking
+func dumpBytes(w io.Writer, data []byte, spec string) error {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("-dump-at must be OFFSET:LEN, got %q", spec)
+	}
+	offset, err := strconv.ParseUint(parts[0], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid -dump-at offset: %v", err)
+	}
+	length, err := strconv.ParseUint(parts[1], 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid -dump-at length: %v", err)
+	}
+	if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+		return fmt.Errorf("-dump-at range %d:%d is outside the file (%d bytes)", offset, length, len(data))
+	}
+
+	_, err = fmt.Fprint(w, hex.Dump(data[offset:offset+length]))
+	return err
+}
+
+// This function splits data made of several binary cookies blobs appended to each other into the individual blobs. As
+// "cook" can also appear inside cookie data (e.g. a cookie named "cookie"), the search for the next blob's magic number
+// starts from where the current blob's header says its pages end, rather than from the start of the blob
+func splitConcatenated(data []byte) [][]byte {
+	var segments [][]byte
+	start := 0
+	for start < len(data) {
+		pagesEnd := start + declaredPagesLength(data[start:])
+		next := bytes.Index(data[pagesEnd:], []byte(*magic))
+		if next < 0 {
+			segments = append(segments, data[start:])
+			break
+		}
+		segments = append(segments, data[start:pagesEnd+next])
+		start = pagesEnd + next
+	}
+	return segments
+}
+
+// This function returns the length of the header plus all pages declared by the header of a binary cookies blob, capped
+// to the length of data if the header is truncated or claims more than there is
+func declaredPagesLength(data []byte) int {
+	decoder := quietDecoder()
+	header, err := decoder.ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		return len(data)
+	}
+	if length := decoder.DeclaredLength(header, data); length < uint64(len(data)) {
+		return int(length)
+	}
+	return len(data)
+}
+
+// This function checks that the header of a binary cookies file parses (the magic number, page count, and a size for
+// every page) and that the pages it declares fit in the file, then prints it. The pages themselves aren't read, so this
+// is much faster than decoding for checking whether a lot of files are intact. An error is returned if the header is bad
+func printHeader(w io.Writer, data []byte) error {
+	decoder := newDecoder()
+	header, err := decoder.ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	total := decoder.DeclaredLength(header, data)
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "Magic: %s\n", data[:4])
+	fmt.Fprintf(bw, "Pages: %d\n", header.NumPages)
+	fmt.Fprintf(bw, "Header size: %d bytes\n", header.Size)
+	for i, size := range header.PageSizes {
+		fmt.Fprintf(bw, "Page %d size: %d bytes\n", i+1, size)
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if total > uint64(len(data)) {
+		return &binarycookies.ParseError{Offset: len(data), Msg: fmt.Sprintf("the header and the pages it declares take up %d bytes, but the file is only %d bytes", total, len(data))}
+	}
+	return nil
+}
+
+// This function walks a directory (such as an iOS backup, where cookie files are stored under hashed names) and decodes
+// every file that starts with the binary cookies magic number, regardless of its name or extension. Each cookie has its
+// Source set to the path of the file it came from. Files that aren't binary cookies files are skipped silently
+func decodeBackupDirectory(dir string, filter *jarFilter) ([]cookie, []string, error) {
+	var result []cookie
+	var warnings []string
+	err := walkBackupDirectory(dir, func(path string, data []byte, err error) {
+		if err != nil {
+			if *debug {
+				debugf("Skipping %s: %v\n", path, err)
+			}
+			return
+		}
+
+		if *debug {
+			debugf("Decoding binary cookies file: %s\n", path)
+		}
+		cookies, fileWarnings, err := decodeJar(data, path, filter)
+		if err != nil {
+			if *debug {
+				debugf("Skipping %s: %v\n", path, err)
+			}
+			return
+		}
+		result = append(result, cookies...)
+		warnings = append(warnings, fileWarnings...)
+	})
+	return result, warnings, err
+}
+
+// This function calls fn with the path and contents of every binary cookies file in dir (and its subdirectories), or
+// with the error if a file couldn't be read. Anything else (directories that can't be listed, and files that aren't
+// binary cookies files) is skipped
+func walkBackupDirectory(dir string, fn func(path string, data []byte, err error)) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if *debug {
+				debugf("Skipping %s: %v\n", path, err)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fn(path, nil, err)
+			return nil
+		}
+		if !bytes.HasPrefix(data, []byte(*magic)) {
+			if *debug {
+				debugf("Skipping %s: not a binary cookies file\n", path)
+			}
+			return nil
+		}
+		if _, err := quietDecoder().ReadHeader(bytes.NewReader(data)); err != nil {
+			fn(path, nil, err)
+			return nil
+		}
+		fn(path, data, nil)
+		return nil
+	})
+}
+
+// A fileStats is one row of -stats-per-file output, describing how decoding a file went
+type fileStats struct {
+	File     string `json:"file"`
+	Cookies  int    `json:"cookies"`
+	Pages    int    `json:"pages"`
+	Warnings int    `json:"warnings"`
+	// OK, warnings (decoded, but with warnings), or error (couldn't be decoded)
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// This function decodes a single file for -stats-per-file output. err is the error from reading it, if there was one
+func buildFileStats(path string, data []byte, err error) fileStats {
+	row := fileStats{File: path, Status: "OK"}
+	if err == nil {
+		var meta binarycookies.FileInfo
+		var cookies []cookie
+		meta, cookies, err = parseWithInfo(data)
+		row.Cookies, row.Pages, row.Warnings = len(cookies), len(meta.Pages), len(meta.Warnings)
+	}
+	if err != nil {
+		row.Status, row.Error = "error", err.Error()
+	} else if row.Warnings > 0 {
+		row.Status = "warnings"
+	}
+	return row
+}
+
+// This function writes a row for each file processed (the -i file, or each binary cookies file found with -backup),
+// giving its cookie count, page count, and whether it decoded cleanly, as a manifest of a sweep. It is written as a
+// table, or with -f json as JSON, to the -o file if one was given or stdout otherwise
+func writeFileStats() error {
+	var rows []fileStats
+	if *backup != "" {
+		err := walkBackupDirectory(*backup, func(path string, data []byte, err error) {
+			rows = append(rows, buildFileStats(path, data, err))
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		path := *file
+		if *hexInput != "" {
+			path = "-hex"
+		}
+		data, err := readInputData()
+		rows = append(rows, buildFileStats(path, data, err))
+	}
+
+	write := func(w io.Writer) error {
+		if *format == "json" {
+			if rows == nil {
+				rows = []fileStats{}
+			}
+			marshalled, err := json.Marshal(rows)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(w, string(marshalled))
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "File\tCookies\tPages\tWarnings\tStatus")
+		for _, row := range rows {
+			status := row.Status
+			if row.Error != "" {
+				status += ": " + row.Error
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\n", row.File, row.Cookies, row.Pages, row.Warnings, status)
+		}
+		return tw.Flush()
+	}
+	return writeToOutput(*outputPath, write)
+}
+
+// This function lowercases the domain of each cookie and strips a single leading dot, so .Example.com becomes example.com.
+// The original domain is kept in RawDomain
+func normalizeCookieDomains(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		cookies[i].RawDomain = cookies[i].Domain
+		cookies[i].Domain = strings.TrimPrefix(strings.ToLower(cookies[i].Domain), ".")
+	}
+}
+
+// This function writes a line for every cookie field (name, value, domain, or path) that contains text, giving the file
+// the cookie came from, its domain and name, and the field that matched. With -ignore-case, case is ignored when matching
+func printSearchResults(w io.Writer, cookies []cookie, text string) error {
+	contains := strings.Contains
+	if *ignoreCase {
+		contains = func(s, substr string) bool { return strings.Contains(strings.ToLower(s), strings.ToLower(substr)) }
+	}
+
+	bw := bufio.NewWriter(w)
+	matches := 0
+	for i := 0; i < len(cookies); i++ {
+		source := cookies[i].Source
+		if source == "" && *file != "" {
+			source = *file
+		} else if source == "" {
+			source = "-hex"
+		}
+		fields := []struct{ name, value string }{
+			{"name", cookies[i].Name},
+			{"value", cookies[i].Value},
+			{"domain", cookies[i].Domain},
+			{"path", cookies[i].Path},
+		}
+		for _, field := range fields {
+			if contains(field.value, text) {
+				matches++
+				fmt.Fprintf(bw, "%s: %s %s (%s): %s\n", source, cookies[i].Domain, cookies[i].Name, field.name, field.value)
+			}
+		}
+	}
+	if *debug {
+		debugf("Found %d matches for %q in %d cookies\n", matches, text, len(cookies))
+	}
+	return bw.Flush()
+}
+
+// This function percent-decodes the value (with -url-decode) and name (with -url-decode-names) of each cookie, so encoded
+// values are readable. Anything that isn't validly encoded is left as it is. With -with-raw, the original of anything
+// that changed is kept in RawValue or RawName
+func urlDecodeCookies(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		if *urlDecode {
+			if decoded, err := url.QueryUnescape(cookies[i].Value); err == nil && decoded != cookies[i].Value {
+				if *withRaw {
+					cookies[i].RawValue = cookies[i].Value
+				}
+				cookies[i].Value = decoded
+			}
+		}
+		if *urlDecodeNames {
+			if decoded, err := url.QueryUnescape(cookies[i].Name); err == nil && decoded != cookies[i].Name {
+				if *withRaw {
+					cookies[i].RawName = cookies[i].Name
+				}
+				cookies[i].Name = decoded
+			}
+		}
+	}
+}
+
+// This function sorts the cookies by the given key, in descending order if descending is true. Cookies that are equal on
+// the key are always ordered by domain and then name (ascending), so the output is the same on every run. Note that
+// "creation" sorts on the second timestamp in each cookie, which is the date the cookie was created (output as
+// LastAccessed)
+func sortCookies(cookies []cookie, key string, descending bool) {
+	compare := func(a, b cookie) int {
+		switch key {
+		case "name":
+			return strings.Compare(a.Name, b.Name)
+		case "domain":
+			return strings.Compare(a.Domain, b.Domain)
+		case "path":
+			return strings.Compare(a.Path, b.Path)
+		case "expires":
+			return a.expiresTime.Compare(b.expiresTime)
+		case "creation":
+			return a.lastAccessedTime.Compare(b.lastAccessedTime)
+		}
+		return 0
+	}
+
+	sort.SliceStable(cookies, func(i, j int) bool {
+		if c := compare(cookies[i], cookies[j]); c != 0 {
+			if descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		if cookies[i].Domain != cookies[j].Domain {
+			return cookies[i].Domain < cookies[j].Domain
+		}
+		return cookies[i].Name < cookies[j].Name
+	})
+}
+
+// This function sorts the cookies by domain, then path, then name, then value. This gives the same order for the same set
+// of cookies however they were read in (e.g. from several files in a -backup directory), so the output of two runs can
+// be diffed
+func canonicalSortCookies(cookies []cookie) {
+	sort.SliceStable(cookies, func(i, j int) bool {
+		a, b := cookies[i], cookies[j]
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Value < b.Value
+	})
+}
+
+// This function merges cookies that share a domain, path, and name (such as the same cookie saved in several backups of
+// a device) into one, keeping the version with the latest creation time. Each merged cookie stays where the first of its
+// versions was, so the output is still in file order
+func mergeNewest(cookies []cookie) []cookie {
+	var result []cookie
+	index := make(map[[3]string]int)
+	for i := 0; i < len(cookies); i++ {
+		key := [3]string{cookies[i].Domain, cookies[i].Path, cookies[i].Name}
+		j, seen := index[key]
+		if !seen {
+			index[key] = len(result)
+			result = append(result, cookies[i])
+			continue
+		}
+		if cookies[i].lastAccessedTime.After(result[j].lastAccessedTime) {
+			result[j] = cookies[i]
+		}
+	}
+	if *debug {
+		debugf("Merged %d cookies into %d, keeping the newest of each domain, path, and name\n", len(cookies), len(result))
+	}
+	return result
+}
+
+// A jarFilter picks the cookies to output from each decoded jar: those for the -domain domain, whose domain matches a
+// pattern in the -allow-domains list (if there is one), and doesn't match one in the -deny-domains list, so deny takes
+// precedence. The filters look at the domains as they were decoded, so they are applied to the jar rather than to the
+// cookies for output
+type jarFilter struct {
+	domain   string
+	allow    []string
+	deny     []string
+	useAllow bool
+}
+
+// This function builds the jarFilter for the command line flags. The domain list files are read here, once, rather than
+// for every jar (with -backup or -split there can be many)
+func newJarFilter() (*jarFilter, error) {
+	filter := &jarFilter{domain: *domainFilter, useAllow: *allowDomains != ""}
+	var err error
+	if *allowDomains != "" {
+		if filter.allow, err = readDomainList(*allowDomains); err != nil {
+			return nil, err
+		}
+	}
+	if *denyDomains != "" {
+		if filter.deny, err = readDomainList(*denyDomains); err != nil {
+			return nil, err
+		}
+	}
+	return filter, nil
+}
+
+// This method returns the cookies in j that the filter keeps, in file order
+func (f *jarFilter) apply(j *binarycookies.Jar) []binarycookies.Cookie {
+	cookies := j.Cookies
+	if f.domain != "" {
+		cookies = j.ByDomain(f.domain)
+	}
+	if !f.useAllow && len(f.deny) == 0 {
+		return cookies
+	}
+
+	var result []binarycookies.Cookie
+	for i := 0; i < len(cookies); i++ {
+		if f.useAllow && !domainMatchesAny(cookies[i].Domain, f.allow) {
+			continue
+		}
+		if domainMatchesAny(cookies[i].Domain, f.deny) {
+			continue
+		}
+		result = append(result, cookies[i])
+	}
+	if *debug {
+		debugf("Kept %d of %d cookies after the domain allow/deny lists\n", len(result), len(cookies))
+	}
+	return result
+}
+
+// This function reads a domain list file, with one pattern per line. Blank lines and lines starting with # are ignored
+func readDomainList(listPath string) ([]string, error) {
+	data, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("invalid domain pattern %q in %s: %v", line, listPath, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// This function checks whether a domain matches any of the patterns. Like -domain, case and a leading dot are ignored, and
+// a pattern can use * as a wildcard (e.g. *.example.com for every subdomain of example.com). Domains aren't file paths,
+// so patterns are matched with path.Match, which works the same on every platform (filepath.Match doesn't treat \ as an
+// escape on Windows)
+func domainMatchesAny(domain string, patterns []string) bool {
+	domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(strings.ToLower(pattern), ".")
+		if matched, _ := path.Match(pattern, domain); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// This function returns the Shannon entropy of s in bits per byte, from 0 (empty, or one byte repeated) up to 8. Random
+// tokens and secrets score highly (a random hex string is close to 4, and random base64 close to 6), while words and
+// preference values like "true" or "en-GB" score low
+func shannonEntropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// This function sets each cookie's ID to the first 16 hex digits of the SHA-256 of its domain, path, and name (separated
+// by NUL bytes, which can't appear in any of them). The same cookie gets the same ID on every run and platform, so
+// exports from different times or devices can be joined on it
+func addCookieIDs(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		sum := sha256.Sum256([]byte(cookies[i].Domain + "\x00" + cookies[i].Path + "\x00" + cookies[i].Name))
+		cookies[i].ID = hex.EncodeToString(sum[:8])
+	}
+}
+
+// This function sets each cookie's ValueEntropy, rounded to 2 decimal places as more precision isn't meaningful
+func addValueEntropy(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		entropy := math.Round(shannonEntropy(cookies[i].Value)*100) / 100
+		cookies[i].ValueEntropy = &entropy
+	}
+}
+
+// This function returns the cookies whose value contains text, ignoring case if ignoreCase is set
+func filterByValue(cookies []cookie, text string, ignoreCase bool) []cookie {
+	if ignoreCase {
+		text = strings.ToLower(text)
+	}
+	var result []cookie
+	for i := 0; i < len(cookies); i++ {
+		value := cookies[i].Value
+		if ignoreCase {
+			value = strings.ToLower(value)
+		}
+		if strings.Contains(value, text) {
+			result = append(result, cookies[i])
+		}
+	}
+	return result
+}
+
+// This function returns the cookies whose value has at least min bits per byte of entropy
+func filterByEntropy(cookies []cookie, min float64) []cookie {
+	var result []cookie
+	for i := 0; i < len(cookies); i++ {
+		if shannonEntropy(cookies[i].Value) >= min {
+			result = append(result, cookies[i])
+		}
+	}
+	if *debug {
+		debugf("Kept %d of %d cookies with a value entropy of at least %g\n", len(result), len(cookies), min)
+	}
+	return result
+}
+
+// This function returns the last n cookies of the slice. An n of 0 or less means all of them, so the slice is returned
+// untouched
+func tailCookies(cookies []cookie, n int) []cookie {
+	if n <= 0 || n >= len(cookies) {
+		return cookies
+	}
+	if *debug {
+		debugf("Keeping the last %d of %d cookies\n", n, len(cookies))
+	}
+	return cookies[len(cookies)-n:]
+}
+
+// This function truncates the cookies slice to the first n cookies. An n of 0 or less means unlimited, so the slice is
+// returned untouched
+func limitCookies(cookies []cookie, n int) []cookie {
+	if n <= 0 || n >= len(cookies) {
+		return cookies
+	}
+	if *debug {
+		debugf("Limiting output to %d of %d cookies\n", n, len(cookies))
+	}
+	return cookies[:n]
+}
+
+// This function takes a slice of cookies and prints them out in a table format
+// With -color, expired cookies have their expiry shown in red, and Secure+HttpOnly cookies have their flags shown in green
+func outputAsTable(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	color := useColor(w)
+	maxLen := truncateLength(w)
+	now := time.Now()
+	for i := 0; i < len(cookies); i++ {
+		expires, lastAccessed := displayTimes(cookies[i], now)
+		flags := cookies[i].Flags
+		if color && !cookies[i].Session && cookies[i].expiresTime.Before(now) {
+			expires = ansiRed + expires + ansiReset
+		}
+		if color && flags == "Secure; HttpOnly" {
+			flags = ansiGreen + flags + ansiReset
+		}
+
+		fmt.Fprintf(bw, "Cookie %d: %s=", i+1, cookies[i].Name)
+		fmt.Fprintf(bw, "%s; ", truncateValue(cookies[i].Value, maxLen))
+		fmt.Fprintf(bw, "Domain: %s; ", cookies[i].Domain)
+		fmt.Fprintf(bw, "Path: %s; ", cookies[i].Path)
+		fmt.Fprintf(bw, "Expires: %v; ", expires)
+		fmt.Fprintf(bw, "Last Accessed: %v; ", lastAccessed)
+		if cookies[i].Source != "" {
+			fmt.Fprintf(bw, "Source: %s; ", cookies[i].Source)
+		}
+		fmt.Fprintf(bw, "%s\n", flags)
+	}
+	return bw.Flush()
+}
+
+// This function returns the expiry and creation (Last Accessed) times of a cookie as shown in table and list output. With
+// -relative-time they are given relative to now, otherwise they are the usual timestamps. Session cookies keep their
+// -session-label either way
+func displayTimes(c cookie, now time.Time) (string, string) {
+	if !*relativeTime {
+		return c.Expires, c.LastAccessed
+	}
+	expires := c.Expires
+	if !c.Session {
+		expires = formatRelative(c.expiresTime.Sub(now))
+	}
+	return expires, formatRelative(c.lastAccessedTime.Sub(now))
+}
+
+// This function formats how far a time is from now as a short human duration, like "in 3d" for a time in the future or
+// "2y ago" for one in the past. Only the largest whole unit is shown, as this is meant for reading at a glance
+func formatRelative(d time.Duration) string {
+	suffix := func(text string) string { return "in " + text }
+	if d < 0 {
+		d = -d
+		suffix = func(text string) string { return text + " ago" }
+	}
+
+	day := 24 * time.Hour
+	var text string
+	switch {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		text = fmt.Sprintf("%dm", d/time.Minute)
+	case d < day:
+		text = fmt.Sprintf("%dh", d/time.Hour)
+	case d < 365*day:
+		text = fmt.Sprintf("%dd", d/day)
+	default:
+		text = fmt.Sprintf("%dy", d/(365*day))
+	}
+	return suffix(text)
+}
+
+// ANSI escape codes used to color table output
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+// This function decides whether to color output written to w, based on -color. With auto (the default), output is only
+// colored when w is a terminal, so codes never end up in files or pipes. Following the NO_COLOR convention
+// (https://no-color.org), a non-empty NO_COLOR environment variable turns color off, even with -color always
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	switch *colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return isTerminal(w)
+}
+
+// This function returns true if w is a terminal rather than a file or pipe
+func isTerminal(w io.Writer) bool {
+	// Output piped to a pager ends up on the terminal, so it gets color and auto truncation like the terminal would
+	if _, ok := w.(pagerWriter); ok {
+		return true
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// A pagerWriter is the input of the pager started by writePagedOutput
+type pagerWriter struct {
+	io.WriteCloser
+}
+
+// This function writes the cookies through the user's pager ($PAGER, or less -R), so a long table can be scrolled. If
+// the pager can't be found or started, the cookies are printed as usual instead
+func writePagedOutput(cookies []cookie) error {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -R"
+	}
+	args := strings.Fields(pager)
+	if len(args) == 0 {
+		return writeOutput(os.Stdout, cookies, nil)
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		if *debug {
+			debugf("Pager %q not found, printing the output instead: %v\n", args[0], err)
+		}
+		return writeOutput(os.Stdout, cookies, nil)
+	}
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		if *debug {
+			debugf("Couldn't start pager %q, printing the output instead: %v\n", pager, err)
+		}
+		return writeOutput(os.Stdout, cookies, nil)
+	}
+
+	writeErr := writeOutput(pagerWriter{stdin}, cookies, nil)
+	stdin.Close()
+	waitErr := cmd.Wait()
+	// Quitting the pager before the end of the output closes the pipe, which isn't an error
+	if writeErr != nil && !errors.Is(writeErr, syscall.EPIPE) {
+		return writeErr
+	}
+	return waitErr
+}
+
+// This function returns the number of characters values written to w are capped at, based on -truncate, with 0 meaning
+// no limit. With auto, the limit is the terminal width (from $COLUMNS, or 80 if that isn't set), and only applies when
+// w is a terminal. Truncation is off unless asked for, so output is lossless by default
+func truncateLength(w io.Writer) int {
+	switch *truncate {
+	case "":
+		return 0
+	case "auto":
+		if !isTerminal(w) {
+			return 0
+		}
+		return terminalWidth()
+	}
+	n, _ := strconv.Atoi(*truncate)
+	return n
+}
+
+// This function returns the width of the terminal, from $COLUMNS, or 80 if that isn't set
+func terminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+// This function shortens value to at most maxLen characters, ending it with an ellipsis if anything was cut off. A maxLen
+// of 0 or less leaves the value untouched
+func truncateValue(value string, maxLen int) string {
+	if maxLen <= 0 || utf8.RuneCountInString(value) <= maxLen {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:maxLen-1]) + "…"
+}
+
+// This function prints the cookies as a table with a row for each cookie and aligned columns for its name, domain, expiry,
+// and flags, for scanning by eye. When printing to a terminal, the names and domains are cut down so each row fits the
+// terminal width. The other fields are left out, and are in the other formats
+func outputAsCompactTable(w io.Writer, cookies []cookie) error {
+	now := time.Now()
+	rows := [][]string{{"Name", "Domain", "Expires", "Flags"}}
+	for i := 0; i < len(cookies); i++ {
+		expires, _ := displayTimes(cookies[i], now)
+		rows = append(rows, []string{compactTableCell(cookies[i].Name), compactTableCell(cookies[i].Domain), expires, cookies[i].Flags})
+	}
+	if isTerminal(w) {
+		fitColumns(rows, terminalWidth())
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// This function makes a name or domain safe for tabwriter, which would take a tab or line break in it as the end of the
+// cell, and a 0xff byte (as found in misparsed strings) as an escape character. Other control characters take up no
+// space on a terminal, so they would throw the columns out too, and are replaced with spaces as well
+func compactTableCell(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, strings.ToValidUTF8(text, "\uFFFD"))
+}
+
+// This function shortens the name and domain columns (the first two) of rows, widest first, until a row with 2 spaces
+// between each column fits in width characters. Neither is cut below 8 characters, so a very narrow terminal still
+// gets readable (if wrapped) rows
+func fitColumns(rows [][]string, width int) {
+	const minWidth = 8
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	total := 2 * (len(widths) - 1)
+	for _, n := range widths {
+		total += n
+	}
+
+	for total > width {
+		widest := 0
+		if widths[1] > widths[0] {
+			widest = 1
+		}
+		if widths[widest] <= minWidth {
+			break
+		}
+		widths[widest]--
+		total--
+	}
+	for _, row := range rows {
+		row[0], row[1] = truncateValue(row[0], widths[0]), truncateValue(row[1], widths[1])
+	}
+}
+
+// This function takes a slice of cookies and prints them out in a list format
+func outputAsList(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	maxLen := truncateLength(w)
+	now := time.Now()
+	for i := 0; i < len(cookies); i++ {
+		expires, lastAccessed := displayTimes(cookies[i], now)
+		fmt.Fprintf(bw, "Name: %s\n", cookies[i].Name)
+		fmt.Fprintf(bw, "Value: %s\n", truncateValue(listValue(cookies[i].Value), maxLen))
+		fmt.Fprintf(bw, "Domain: %s\n", cookies[i].Domain)
+		fmt.Fprintf(bw, "Path: %s\n", cookies[i].Path)
+		fmt.Fprintf(bw, "Expires: %v\n", expires)
+		fmt.Fprintf(bw, "Last Accessed: %v\n", lastAccessed)
+		if cookies[i].Source != "" {
+			fmt.Fprintf(bw, "Source: %s\n", cookies[i].Source)
+		}
+		fmt.Fprintf(bw, "Flags: %s\n\n", cookies[i].Flags)
+	}
+	return bw.Flush()
+}
+
+// This function returns a cookie value for list output. With -expand-json-values, values that are JSON are indented over
+// several lines, otherwise the value is returned as it is
+func listValue(value string) string {
+	if !*expandJSONValues || !isJSONContainer(value) {
+		return value
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(strings.TrimSpace(value)), "", "  "); err != nil {
+		return value
+	}
+	return buf.String()
+}
+
+// An anomaly is a cookie that looks suspicious, along with the reasons why
+type anomaly struct {
+	cookie  cookie
+	reasons []string
+}
+
+// This function checks each cookie for things that are worth a closer look during triage (oversized values, empty names,
+// non-ASCII domains, which are told apart as IDN or misparsed, and duplicates with conflicting values) and returns the cookies that have at least one of them
+func findAnomalies(cookies []cookie) []anomaly {
+	// Group the cookies by domain, path, and name (and the file they came from with -backup), to find duplicates
+	byKey := make(map[[4]string][]int)
+	for i := 0; i < len(cookies); i++ {
+		key := [4]string{cookies[i].Source, cookies[i].Domain, cookies[i].Path, cookies[i].Name}
+		byKey[key] = append(byKey[key], i)
+	}
+
+	var result []anomaly
+	for i := 0; i < len(cookies); i++ {
+		var reasons []string
+		// The same domain, path, and name shouldn't appear twice in a file, so a second value often means an offset was
+		// misread. Each of the cookies is flagged, naming the other's value, so both records are shown
+		key := [4]string{cookies[i].Source, cookies[i].Domain, cookies[i].Path, cookies[i].Name}
+		otherValues := make(map[string]bool)
+		for _, j := range byKey[key] {
+			if cookies[j].Value != cookies[i].Value && !otherValues[cookies[j].Value] {
+				otherValues[cookies[j].Value] = true
+				reasons = append(reasons, fmt.Sprintf("duplicate of another cookie with the same domain, path, and name, but the value %q", cookies[j].Value))
+			}
+		}
+		if *maxValueLen > 0 && len(cookies[i].Value) > *maxValueLen {
+			reasons = append(reasons, fmt.Sprintf("value is %d bytes (longer than %d)", len(cookies[i].Value), *maxValueLen))
+		}
+		if cookies[i].Name == "" {
+			reasons = append(reasons, "name is empty")
+		}
+		reasons = append(reasons, cookies[i].Warnings...)
+		if reason := domainASCIIReason(cookies[i].Domain); reason != "" {
+			reasons = append(reasons, reason)
+		}
+		if len(reasons) > 0 {
+			result = append(result, anomaly{cookie: cookies[i], reasons: reasons})
+		}
+	}
+	return result
+}
+
+// This function returns true if every byte in s is ASCII
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+// This function explains why a domain isn't plain ASCII, or returns "" if it is. A domain that is valid UTF-8 and made up
+// only of letters, digits, dots, and hyphens is most likely a legitimate internationalized (IDN) domain, and is named as
+// such. Anything else (invalid UTF-8, control characters, symbols) is more likely binary that was misparsed as the domain
+func domainASCIIReason(domain string) string {
+	if isASCII(domain) {
+		return ""
+	}
+	if !utf8.ValidString(domain) {
+		return "domain contains non-ASCII bytes that aren't valid UTF-8 (possibly misparsed)"
+	}
+	for _, r := range domain {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) && r != '.' && r != '-' {
+			return fmt.Sprintf("domain contains non-ASCII bytes and the character %q, which isn't valid in a hostname (possibly misparsed)", r)
+		}
+	}
+	return "domain is an internationalized (IDN) name containing non-ASCII characters"
+}
+
+// This function prints a debug line for each cookie whose domain isn't plain ASCII, saying whether it looks like an IDN
+// domain or a parse error
+func debugNonASCIIDomains(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		if reason := domainASCIIReason(cookies[i].Domain); reason != "" {
+			debugf("Cookie %d (%s): %s: %q\n", i+1, cookies[i].Name, reason, cookies[i].Domain)
+		}
+	}
+}
+
+// This function takes a slice of cookies and prints out only the anomalous ones, each followed by the reasons it was flagged
+func outputAsAnomalies(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	anomalies := findAnomalies(cookies)
+	for i := 0; i < len(anomalies); i++ {
+		fmt.Fprintf(bw, "Cookie %d: %s=", i+1, anomalies[i].cookie.Name)
+		fmt.Fprintf(bw, "%s; ", anomalies[i].cookie.Value)
+		fmt.Fprintf(bw, "Domain: %s; ", anomalies[i].cookie.Domain)
+		fmt.Fprintf(bw, "Path: %s\n", anomalies[i].cookie.Path)
+		for _, reason := range anomalies[i].reasons {
+			fmt.Fprintf(bw, "  - %s\n", reason)
+		}
+	}
+	if *debug {
+		debugf("Found %d anomalous cookies out of %d\n", len(anomalies), len(cookies))
+	}
+	return bw.Flush()
+}
+
+// A domainGroup holds all the cookies for a single domain, further grouped by path
+type domainGroup struct {
+	domain string
+	paths  []pathGroup
+}
+
+// A pathGroup holds all the cookies for a single path within a domain
+type pathGroup struct {
+	path    string
+	cookies []cookie
+}
+
+// This function groups a slice of cookies by domain and then by path. Domains and paths are sorted alphabetically, while
+// the cookies within each path keep the order they were decoded in
+func groupByDomainAndPath(cookies []cookie) []domainGroup {
+	byDomain := make(map[string]map[string][]cookie)
+	for i := 0; i < len(cookies); i++ {
+		if byDomain[cookies[i].Domain] == nil {
+			byDomain[cookies[i].Domain] = make(map[string][]cookie)
+		}
+		byDomain[cookies[i].Domain][cookies[i].Path] = append(byDomain[cookies[i].Domain][cookies[i].Path], cookies[i])
+	}
+
+	var result []domainGroup
+	for domain, byPath := range byDomain {
+		group := domainGroup{domain: domain}
+		for path, pathCookies := range byPath {
+			group.paths = append(group.paths, pathGroup{path: path, cookies: pathCookies})
+		}
+		sort.Slice(group.paths, func(a, b int) bool { return group.paths[a].path < group.paths[b].path })
+		result = append(result, group)
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].domain < result[b].domain })
+	return result
+}
+
+// This function takes a slice of cookies and prints each domain they are for once, sorted alphabetically, giving a list of
+// the sites the cookies came from
+func outputAsDomains(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	seen := make(map[string]bool)
+	var domains []string
+	for i := 0; i < len(cookies); i++ {
+		if !seen[cookies[i].Domain] {
+			seen[cookies[i].Domain] = true
+			domains = append(domains, cookies[i].Domain)
+		}
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Fprintln(bw, domain)
+	}
+	return bw.Flush()
+}
+
+// This function takes a slice of cookies and prints them out as a tree of domain -> path -> cookies
+func outputAsTree(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	groups := groupByDomainAndPath(cookies)
+	for _, group := range groups {
+		fmt.Fprintf(bw, "%s\n", group.domain)
+		for i, path := range group.paths {
+			// The last branch at each level gets a corner rather than a tee, and its children don't need the vertical bar
+			pathBranch, childIndent := "├── ", "│   "
+			if i == len(group.paths)-1 {
+				pathBranch, childIndent = "└── ", "    "
+			}
+			fmt.Fprintf(bw, "%s%s\n", pathBranch, path.path)
+			for j, c := range path.cookies {
+				cookieBranch := "├── "
+				if j == len(path.cookies)-1 {
+					cookieBranch = "└── "
+				}
+				fmt.Fprintf(bw, "%s%s%s=%s\n", childIndent, cookieBranch, c.Name, c.Value)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// This function prints the value of the only cookie, with nothing else, for scripts that capture it (e.g. TOKEN=$(...)).
+// It is an error if there isn't exactly one cookie, so a filter that matched nothing or too much isn't silently used
+func outputAsSingle(w io.Writer, cookies []cookie) error {
+	if len(cookies) != 1 {
+		return fmt.Errorf("-f single expects exactly 1 cookie, but there are %d (use -domain to narrow them down)", len(cookies))
+	}
+	_, err := fmt.Fprintln(w, cookies[0].Value)
+	return err
+}
+
+// This function takes a slice of cookies and prints them as an INI file, with a [section] for each domain holding a
+// name = value key for each of its cookies. A name that appears under more than one path in a domain would be a
+// duplicate key, so those keys are given as name@path instead
+func outputAsINI(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	for i, group := range groupByDomainAndPath(cookies) {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "[%s]\n", group.domain)
+
+		paths := make(map[string]map[string]bool)
+		for _, path := range group.paths {
+			for _, c := range path.cookies {
+				if paths[c.Name] == nil {
+					paths[c.Name] = make(map[string]bool)
+				}
+				paths[c.Name][path.path] = true
+			}
+		}
+		for _, path := range group.paths {
+			for _, c := range path.cookies {
+				key := c.Name
+				if len(paths[c.Name]) > 1 {
+					key = c.Name + "@" + path.path
+				}
+				fmt.Fprintf(bw, "%s = %s\n", iniQuote(key), iniQuote(c.Value))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// This function makes a key or value safe to write in an INI file. Text holding characters that INI gives a meaning to
+// (comments, =, quotes, brackets, and line breaks), or with spaces at either end, is put in double quotes, with
+// backslashes, quotes, and control characters escaped inside them. Anything else is written as it is
+func iniQuote(s string) string {
+	if !strings.ContainsAny(s, ";#=\"\\[]\n\r\t") && s == strings.TrimSpace(s) {
+		return s
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + escaper.Replace(s) + `"`
+}
+
+// This function takes a slice of cookies and prints them out as NAME=VALUE lines (with -prefix in front of each name), for
+// tools that read environment style files. Backslashes, newlines, and carriage returns are escaped so each cookie stays on
+// one line
+func outputAsKeyValue(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	escaper := strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	for i := 0; i < len(cookies); i++ {
+		fmt.Fprintf(bw, "%s%s=%s\n", *keyPrefix, escaper.Replace(cookies[i].Name), escaper.Replace(cookies[i].Value))
+	}
+	return bw.Flush()
+}
+
+// This function takes a slice of cookies and prints them out in InfluxDB line protocol, one point per cookie in the
+// cookies measurement. The domain and flags are tags, the name and size are fields, and the timestamp is the creation
+// time (output as Last Accessed elsewhere) in nanoseconds, so cookie creation can be charted over time
+func outputAsInflux(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	// Tag values can't contain unescaped commas, equals signs, or spaces, and can't be empty, so empty tags are left out
+	tagEscaper := strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	fieldEscaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i := 0; i < len(cookies); i++ {
+		line := "cookies"
+		if cookies[i].Domain != "" {
+			line += ",domain=" + tagEscaper.Replace(cookies[i].Domain)
+		}
+		if cookies[i].Flags != "" {
+			line += ",flags=" + tagEscaper.Replace(cookies[i].Flags)
+		}
+		fmt.Fprintf(bw, "%s name=\"%s\",size=%di %d\n", line, fieldEscaper.Replace(cookies[i].Name), cookies[i].Size, cookies[i].lastAccessedTime.UnixNano())
+	}
+	return bw.Flush()
+}
+
+// This function takes a slice of cookies and writes them out as a stream of protobuf Cookie messages (see cookie.proto),
+// each preceded by its length as a varint, the same framing as protobuf's writeDelimitedTo. The wire format is simple
+// enough to write by hand, which keeps the tool free of dependencies. Fields with their zero value are left out, as
+// protobuf does, so session cookies have no expires
+func outputAsProtobuf(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	for i := 0; i < len(cookies); i++ {
+		var msg []byte
+		msg = appendProtobufString(msg, 1, cookies[i].Name)
+		msg = appendProtobufString(msg, 2, cookies[i].Value)
+		msg = appendProtobufString(msg, 3, cookies[i].Domain)
+		msg = appendProtobufString(msg, 4, cookies[i].Path)
+		msg = appendProtobufString(msg, 5, cookies[i].Flags)
+		if !cookies[i].Session {
+			msg = appendProtobufVarint(msg, 6, uint64(cookies[i].expiresTime.Unix()))
+		}
+		msg = appendProtobufVarint(msg, 7, uint64(cookies[i].lastAccessedTime.Unix()))
+		msg = appendProtobufVarint(msg, 8, cookies[i].Size)
+		if cookies[i].Session {
+			msg = appendProtobufVarint(msg, 9, 1)
+		}
+		msg = appendProtobufString(msg, 10, cookies[i].Source)
+		msg = appendProtobufString(msg, 11, cookies[i].ValueEncoding)
+		msg = appendProtobufString(msg, 12, cookies[i].NameEncoding)
+
+		bw.Write(binary.AppendUvarint(nil, uint64(len(msg))))
+		bw.Write(msg)
+	}
+	return bw.Flush()
+}
+
+// This function appends a protobuf varint field (wire type 0) to msg, leaving it out if value is 0. Negative int64s are
+// passed in as their two's complement, as protobuf expects
+func appendProtobufVarint(msg []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return msg
+	}
+	msg = binary.AppendUvarint(msg, uint64(field)<<3)
+	return binary.AppendUvarint(msg, value)
+}
+
+// This function appends a protobuf string field (wire type 2, length-delimited) to msg, leaving it out if value is empty
+func appendProtobufString(msg []byte, field int, value string) []byte {
+	if value == "" {
+		return msg
+	}
+	msg = binary.AppendUvarint(msg, uint64(field)<<3|2)
+	msg = binary.AppendUvarint(msg, uint64(len(value)))
+	return append(msg, value...)
+}
+
+// The flag labels Cookie.FlagText can give a cookie, in the order count-by-flag output lists them
+var flagLabels = []string{"None", "Secure", "HttpOnly", "Secure; HttpOnly", "Unknown"}
+
+// This function takes a slice of cookies and prints how many have each combination of flags, and what percentage of all
+// the cookies that is. Every combination is listed, even if no cookies have it, so the output is easy to compare
+func outputAsCountByFlag(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	counts := make(map[string]int)
+	for i := 0; i < len(cookies); i++ {
+		counts[cookies[i].Flags]++
+	}
+
+	for _, label := range flagLabels {
+		percent := 0.0
+		if len(cookies) > 0 {
+			percent = float64(counts[label]) / float64(len(cookies)) * 100
+		}
+		fmt.Fprintf(bw, "%-16s %6d %6.1f%%\n", label, counts[label], percent)
+	}
+	fmt.Fprintf(bw, "%-16s %6d\n", "Total", len(cookies))
+	return bw.Flush()
+}
+
+// A retentionReport counts cookies by how long they have left before they expire, for data-retention reports
+type retentionReport struct {
+	Session            int `json:"session"`
+	Expired            int `json:"expired"`
+	ExpiresUnder30Days int `json:"expiresUnder30Days"`
+	Expires30To90Days  int `json:"expires30To90Days"`
+	ExpiresOver90Days  int `json:"expiresOver90Days"`
+	Total              int `json:"total"`
+}
+
+// This function sorts the cookies into retention buckets by their expiry relative to now. The days left are counted in
+// calendar days in the local timezone (so a cookie expiring tomorrow morning has 1 day left, whatever the time now), which
+// can be changed with the TZ environment variable
+func buildRetentionReport(cookies []cookie, now time.Time) retentionReport {
+	now = now.In(time.Local)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	report := retentionReport{Total: len(cookies)}
+	for i := 0; i < len(cookies); i++ {
+		if cookies[i].Session {
+			report.Session++
+			continue
+		}
+		expires := cookies[i].expiresTime.In(time.Local)
+		if !expires.After(now) {
+			report.Expired++
+			continue
+		}
+		expiryDay := time.Date(expires.Year(), expires.Month(), expires.Day(), 0, 0, 0, 0, time.Local)
+		// Days aren't always 24 hours long across daylight saving changes, so the difference is rounded
+		days := int(math.Round(expiryDay.Sub(today).Hours() / 24))
+		switch {
+		case days < 30:
+			report.ExpiresUnder30Days++
+		case days <= 90:
+			report.Expires30To90Days++
+		default:
+			report.ExpiresOver90Days++
+		}
+	}
+	return report
+}
+
+// This function takes a slice of cookies and prints how many fall into each retention bucket
+func outputAsRetention(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	report := buildRetentionReport(cookies, time.Now())
+	fmt.Fprintf(bw, "%-16s %6d\n", *sessionLabel, report.Session)
+	fmt.Fprintf(bw, "%-16s %6d\n", "expired", report.Expired)
+	fmt.Fprintf(bw, "%-16s %6d\n", "expires <30d", report.ExpiresUnder30Days)
+	fmt.Fprintf(bw, "%-16s %6d\n", "expires 30-90d", report.Expires30To90Days)
+	fmt.Fprintf(bw, "%-16s %6d\n", "expires >90d", report.ExpiresOver90Days)
+	fmt.Fprintf(bw, "%-16s %6d\n", "Total", report.Total)
+	return bw.Flush()
+}
+
+// This function prints the retention buckets as a JSON object, with keys in the -json-keys style
+func outputAsRetentionJSON(w io.Writer, cookies []cookie) error {
+	marshalled, err := json.Marshal(buildRetentionReport(cookies, time.Now()))
+	if err != nil {
+		return err
+	}
+	if *jsonKeys == "snake" {
+		marshalled, err = rewriteJSONObject(marshalled, func(key string, value json.RawMessage) (string, json.RawMessage) {
+			return camelToSnake(key), value
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(w, string(marshalled))
+	return err
+}
+
+// The widest a bar in histogram output can be, in characters
+const maxHistogramBar = 50
+
+// This function takes a slice of cookies and prints a text bar chart of how many expire in each month or year (set with
+// -bucket). Session cookies have no expiry date, so they are counted on their own line at the end
+func outputAsHistogram(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	layout := "2006-01"
+	if *bucket == "year" {
+		layout = "2006"
+	}
+
+	counts := make(map[string]int)
+	sessions := 0
+	for i := 0; i < len(cookies); i++ {
+		if cookies[i].Session {
+			sessions++
+			continue
+		}
+		counts[cookies[i].expiresTime.Format(layout)]++
+	}
+
+	var buckets []string
+	largest := sessions
+	for b, count := range counts {
+		buckets = append(buckets, b)
+		if count > largest {
+			largest = count
+		}
+	}
+	// The layouts are zero padded and most significant first, so sorting the strings sorts the buckets chronologically
+	sort.Strings(buckets)
+
+	for _, b := range buckets {
+		fmt.Fprintf(bw, "%-7s | %s %d\n", b, histogramBar(counts[b], largest), counts[b])
+	}
+	if sessions > 0 {
+		fmt.Fprintf(bw, "%-7s | %s %d\n", *sessionLabel, histogramBar(sessions, largest), sessions)
+	}
+	return bw.Flush()
+}
+
+// This function returns the bar for a histogram count, scaled so the largest count fills maxHistogramBar characters. Any
+// non-zero count gets at least one character so it stays visible
+func histogramBar(count int, largest int) string {
+	width := count
+	if largest > maxHistogramBar {
+		width = count * maxHistogramBar / largest
+	}
+	if width == 0 && count > 0 {
+		width = 1
+	}
+	return strings.Repeat("#", width)
+}
+
+// This function takes a slice of cookies and prints them out as a XML chunk
+func outputAsXML(w io.Writer, cookies []cookie) error {
+	type Nesting struct {
+		XMLName xml.Name `xml:"Cookies"`
+		Cookie  []cookie
+	}
+
+	nesting := &Nesting{}
+	nesting.Cookie = cookies
+
+	out, err := xml.MarshalIndent(nesting, "", "	")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, xml.Header+string(out))
+	return err
+}
+
+// The header of an XML property list, as written by Apple's tools
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// This function takes a slice of cookies and prints them out as an XML property list: an array with a dict per cookie.
+// The size is an <integer>, the timestamps are <date>s (in UTC, as plists require), and everything else is a <string>.
+// Session cookies have no expiry date, so they get a Session <true/> instead
+func outputAsPlist(w io.Writer, cookies []cookie) error {
+	var buf bytes.Buffer
+	buf.WriteString(plistHeader)
+	buf.WriteString("<array>\n")
+	for i := 0; i < len(cookies); i++ {
+		buf.WriteString("\t<dict>\n")
+		writePlistKey(&buf, "Size")
+		fmt.Fprintf(&buf, "<integer>%d</integer>\n", cookies[i].Size)
+		writePlistString(&buf, "Name", cookies[i].Name)
+		writePlistString(&buf, "Value", cookies[i].Value)
+		writePlistString(&buf, "Domain", cookies[i].Domain)
+		writePlistString(&buf, "Path", cookies[i].Path)
+		writePlistString(&buf, "Flags", cookies[i].Flags)
+		if cookies[i].Session {
+			writePlistKey(&buf, "Session")
+			buf.WriteString("<true/>\n")
+		} else {
+			writePlistDate(&buf, "Expires", cookies[i].expiresTime)
+		}
+		writePlistDate(&buf, "LastAccessed", cookies[i].lastAccessedTime)
+		if cookies[i].Source != "" {
+			writePlistString(&buf, "Source", cookies[i].Source)
+		}
+		buf.WriteString("\t</dict>\n")
+	}
+	buf.WriteString("</array>\n</plist>\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// This function takes a slice of cookies and prints them out as an XML property list of NSHTTPCookie properties dicts, so
+// they can be turned back into cookies with NSHTTPCookie's cookieWithProperties:. The flags are split into the Secure and
+// HttpOnly booleans, and session cookies have no Expires but a Discard <true/> instead, as NSHTTPCookie expects
+func outputAsAppleCookiesPlist(w io.Writer, cookies []cookie) error {
+	var buf bytes.Buffer
+	buf.WriteString(plistHeader)
+	buf.WriteString("<array>\n")
+	for i := 0; i < len(cookies); i++ {
+		buf.WriteString("\t<dict>\n")
+		writePlistString(&buf, "Name", cookies[i].Name)
+		writePlistString(&buf, "Value", cookies[i].Value)
+		writePlistString(&buf, "Domain", cookies[i].Domain)
+		writePlistString(&buf, "Path", cookies[i].Path)
+		if cookies[i].Session {
+			writePlistBool(&buf, "Discard", true)
+		} else {
+			writePlistDate(&buf, "Expires", cookies[i].expiresTime)
+		}
+		writePlistBool(&buf, "Secure", strings.Contains(cookies[i].Flags, "Secure"))
+		writePlistBool(&buf, "HttpOnly", strings.Contains(cookies[i].Flags, "HttpOnly"))
+		buf.WriteString("\t</dict>\n")
+	}
+	buf.WriteString("</array>\n</plist>\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// This function writes the <key> element of a plist dict entry and indents the next line, leaving the value for the
+// caller to write
+func writePlistKey(buf *bytes.Buffer, key string) {
+	buf.WriteString("\t\t<key>")
+	xml.EscapeText(buf, []byte(key))
+	buf.WriteString("</key>\n\t\t")
+}
+
+// This function writes a plist dict entry with a <string> value, escaping it for XML
+func writePlistString(buf *bytes.Buffer, key string, value string) {
+	writePlistKey(buf, key)
+	buf.WriteString("<string>")
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteString("</string>\n")
+}
+
+// This function writes a plist dict entry with a <true/> or <false/> value
+func writePlistBool(buf *bytes.Buffer, key string, value bool) {
+	writePlistKey(buf, key)
+	if value {
+		buf.WriteString("<true/>\n")
+	} else {
+		buf.WriteString("<false/>\n")
+	}
+}
+
+// This function writes a plist dict entry with a <date> value, which plists require to be in UTC
+func writePlistDate(buf *bytes.Buffer, key string, value time.Time) {
+	writePlistKey(buf, key)
+	fmt.Fprintf(buf, "<date>%s</date>\n", value.UTC().Format("2006-01-02T15:04:05Z"))
+}
+
+// This function takes a slice of cookies and prints them out as a JSON chunk. The array is written a cookie at a time
+// rather than marshalled all at once, so a large cache doesn't need a second copy of itself in memory as JSON
+func outputAsJSON(w io.Writer, cookies []cookie) error {
+	bw := bufio.NewWriter(w)
+	if err := writeJSONArray(bw, cookies); err != nil {
+		return err
+	}
+	bw.WriteString("\n")
+	return bw.Flush()
+}
+
+// This function prints the cookies as JSON for -wrap: an object holding them alongside the warnings found while parsing
+// the files they came from, as {"cookies":[...],"warnings":[...]}, so automated consumers can tell when the data may be
+// incomplete
+func outputAsWrappedJSON(w io.Writer, cookies []cookie, warnings []string) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"cookies":`)
+	if err := writeJSONArray(bw, cookies); err != nil {
+		return err
+	}
+	marshalled, err := json.Marshal(append([]string{}, warnings...))
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`,"warnings":`)
+	bw.Write(marshalled)
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// This function writes the cookies to w as a JSON array, marshalling one cookie at a time. The output is exactly what
+// json.Marshal would give for the whole slice, including null for a nil slice
+func writeJSONArray(w *bufio.Writer, cookies []cookie) error {
+	if cookies == nil {
+		_, err := w.WriteString("null")
+		return err
+	}
+	w.WriteByte('[')
+	for i := 0; i < len(cookies); i++ {
+		marshalled, err := json.Marshal(cookies[i])
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.Write(marshalled)
+	}
+	_, err := w.WriteString("]")
+	return err
+}
+
+// This method lets the JSON output be adjusted at marshal time. The cookie is marshalled using its struct tags (which are
+// camelCase), then if -expand-json-values was given and the value is itself JSON, it is nested as-is rather than as an
+// escaped string, and if snake_case was requested with -json-keys, each key is rewritten
+func (c cookie) MarshalJSON() ([]byte, error) {
+	// plainCookie has the same fields and tags as cookie but not this method, so marshalling it doesn't recurse
+	type plainCookie cookie
+	marshalled, err := json.Marshal(plainCookie(c))
+	if err != nil {
+		return nil, err
+	}
+	expandValue := *expandJSONValues && isJSONContainer(c.Value)
+	if !expandValue && *jsonKeys != "snake" && len(fieldRenames) == 0 {
+		return marshalled, nil
+	}
+	return rewriteJSONObject(marshalled, func(key string, value json.RawMessage) (string, json.RawMessage) {
+		if key == "value" && expandValue {
+			value = json.RawMessage(c.Value)
+		}
+		if renamed, ok := fieldRenames[key]; ok {
+			key = renamed
+		} else if *jsonKeys == "snake" {
+			key = camelToSnake(key)
+		}
+		return key, value
+	})
+}
+
+// This function takes a marshalled JSON object and returns it with every top level key and value passed through rewrite.
+// The order of the keys is kept, as are the exact bytes of any value rewrite doesn't change
+func rewriteJSONObject(data []byte, rewrite func(key string, value json.RawMessage) (string, json.RawMessage)) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Consume the opening brace of the object
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; dec.More(); i++ {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		name, value := rewrite(token.(string), value)
+		key, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// This function returns true if a cookie value is a JSON object or array. Other valid JSON (like a bare number or true)
+// is far more likely to just be a plain value, so isn't treated as JSON
+func isJSONContainer(value string) bool {
+	trimmed := strings.TrimSpace(value)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return false
+	}
+	return json.Valid([]byte(trimmed))
+}
+
+// The template given with -template or -template-file, which replaces the -f format when set
+var outputTemplate *template.Template
+
+// This function parses the template given with -template, or read from the -template-file file. It is parsed before
+// anything is decoded, so a mistake in it is reported straight away
+func parseOutputTemplate() (*template.Template, error) {
+	text := *templateText
+	if *templateFile != "" {
+		data, err := ioutil.ReadFile(*templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New("cookie").Parse(text)
+}
+
+// This function writes each cookie with the -template template, which is executed with the cookie (so it can use any
+// field shown in JSON output, e.g. {{.Name}} or {{.Expires}}). Each cookie's output is ended with a line break, unless the
+// template already ends with one
+func outputAsTemplate(w io.Writer, cookies []cookie) error {
+	var buf bytes.Buffer
+	for i := 0; i < len(cookies); i++ {
+		buf.Reset()
+		if err := outputTemplate.Execute(&buf, cookies[i]); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The new names given with -rename-fields for JSON keys and CSV headers, keyed by their usual (camelCase) names
+var fieldRenames map[string]string
+
+// The timezone given with -timezone, which the -split-datetime columns are in
+var splitLocation = time.Local
+
+// This function parses the -rename-fields mapping (e.g. name=cookie_name,domain=host). Each field must be one of the
+// JSON keys or CSV headers, so a typo is an error rather than silently leaving the field with its usual name
+func parseFieldRenames(spec string) (map[string]string, error) {
+	known := make(map[string]bool)
+	cookieType := reflect.TypeOf(cookie{})
+	for i := 0; i < cookieType.NumField(); i++ {
+		if tag := cookieType.Field(i).Tag.Get("json"); tag != "" {
+			known[strings.Split(tag, ",")[0]] = true
+		}
+	}
+	// -split-datetime's columns are only in CSV output
+	for _, header := range []string{"expires_date", "expires_time", "creation_date", "creation_time"} {
+		known[header] = true
+	}
+
+	renames := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("-rename-fields must be FIELD=NEW pairs separated by commas, got %q", pair)
+		}
+		if !known[parts[0]] {
+			return nil, fmt.Errorf("-rename-fields: unknown field %q", parts[0])
+		}
+		renames[parts[0]] = parts[1]
+	}
+	return renames, nil
+}
+
+// This function converts a camelCase key (like lastAccessed) to its snake_case equivalent (like last_accessed). A run of
+// digits is a word of its own, so expiresUnder30Days becomes expires_under_30_days
+func camelToSnake(key string) string {
+	var result []rune
+	previous := rune(0)
+	for _, r := range key {
+		switch {
+		case unicode.IsUpper(r):
+			result = append(result, '_', unicode.ToLower(r))
+		case unicode.IsDigit(r) && previous != 0 && !unicode.IsDigit(previous):
+			result = append(result, '_', r)
+		default:
+			result = append(result, r)
+		}
+		previous = r
+	}
+	return string(result)
+}
+
+// A csvColumn is a single column of CSV output: its header and how to get its value from a cookie
+type csvColumn struct {
+	header string
+	value  func(c cookie) string
+}
+
+// This function returns the columns to include in CSV output for the given cookies. The standard columns are always
+// present, while the optional ones are only added when at least one cookie has a value for them
+func csvColumns(cookies []cookie) []csvColumn {
+	columns := []csvColumn{
+		{"name", func(c cookie) string { return c.Name }},
+		{"value", func(c cookie) string { return c.Value }},
+		{"domain", func(c cookie) string { return c.Domain }},
+		{"path", func(c cookie) string { return c.Path }},
+	}
+	if *splitDatetime {
+		columns = append(columns,
+			csvColumn{"expires_date", func(c cookie) string { return csvExpiresPart(c, "2006-01-02") }},
+			csvColumn{"expires_time", func(c cookie) string { return csvExpiresPart(c, "15:04:05") }})
+	} else {
+		columns = append(columns, csvColumn{"expires", func(c cookie) string { return c.Expires }})
+	}
+
+	// The raw timestamps go next to their formatted versions
+	if *rawTime {
+		columns = append(columns, csvColumn{"expiresRaw", func(c cookie) string { return formatRawTime(c.ExpiresRaw) }})
+	}
+	if *macTime {
+		columns = append(columns, csvColumn{"expiresMacTime", func(c cookie) string { return formatMacTime(c.ExpiresMacTime) }})
+	}
+	// The second timestamp is when the cookie was created (it is output as lastAccessed elsewhere), so its split columns
+	// are named for that, as -sort creation does
+	if *splitDatetime {
+		columns = append(columns,
+			csvColumn{"creation_date", func(c cookie) string { return c.lastAccessedTime.In(splitLocation).Format("2006-01-02") }},
+			csvColumn{"creation_time", func(c cookie) string { return c.lastAccessedTime.In(splitLocation).Format("15:04:05") }})
+	} else {
+		columns = append(columns, csvColumn{"lastAccessed", func(c cookie) string { return c.LastAccessed }})
+	}
+	if *rawTime {
+		columns = append(columns, csvColumn{"creationRaw", func(c cookie) string { return formatRawTime(c.CreationRaw) }})
+	}
+	if *macTime {
+		columns = append(columns, csvColumn{"lastAccessedMacTime", func(c cookie) string { return formatMacTime(c.LastAccessedMacTime) }})
+	}
+	columns = append(columns, csvColumn{"flags", func(c cookie) string { return c.Flags }})
+	if *rawFlags {
+		columns = append(columns, csvColumn{"flagsRaw", func(c cookie) string { return c.FlagsRaw }})
+	}
+	if *withID {
+		columns = append(columns, csvColumn{"id", func(c cookie) string { return c.ID }})
+	}
+	if *withEntropy {
+		columns = append(columns, csvColumn{"valueEntropy", func(c cookie) string { return formatEntropy(c.ValueEntropy) }})
+	}
+	if *withLengths {
+		columns = append(columns,
+			csvColumn{"nameLen", func(c cookie) string { return formatLength(c.NameLen) }},
+			csvColumn{"valueLen", func(c cookie) string { return formatLength(c.ValueLen) }})
+	}
+
+	withNameEncoding, withValueEncoding, withSource := false, false, false
+	for i := 0; i < len(cookies); i++ {
+		withNameEncoding = withNameEncoding || cookies[i].NameEncoding != ""
+		withValueEncoding = withValueEncoding || cookies[i].ValueEncoding != ""
+		withSource = withSource || cookies[i].Source != ""
+	}
+	if withNameEncoding {
+		columns = append(columns, csvColumn{"nameEncoding", func(c cookie) string { return c.NameEncoding }})
+	}
+	if withValueEncoding {
+		columns = append(columns, csvColumn{"valueEncoding", func(c cookie) string { return c.ValueEncoding }})
+	}
+	if withSource {
+		columns = append(columns, csvColumn{"source", func(c cookie) string { return c.Source }})
+	}
+	return columns
+}
+
+// This function formats the date or time part of a cookie's expiry, in the -timezone, for -split-datetime CSV output.
+// Session cookies have no expiry, so their date column holds the -session-label and their time column is left empty
+func csvExpiresPart(c cookie, layout string) string {
+	if c.Session {
+		if layout == "2006-01-02" {
+			return c.Expires
+		}
+		return ""
+	}
+	return c.expiresTime.In(splitLocation).Format(layout)
+}
+
+// This function sets the ExpiresWeek and CreationWeek of each cookie to the ISO 8601 week (like 2021-W03) its expiry and
+// creation dates fall in. Session cookies have no expiry date, so only get a CreationWeek
+func addISOWeeks(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		if !cookies[i].Session {
+			cookies[i].ExpiresWeek = formatISOWeek(cookies[i].expiresTime)
+		}
+		cookies[i].CreationWeek = formatISOWeek(cookies[i].lastAccessedTime)
+	}
+}
+
+// This function formats the ISO 8601 week a time falls in, like 2021-W03. The year is the ISO year, which can differ from
+// the calendar year in the first and last days of a year
+func formatISOWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+// This function formats a raw Core Data timestamp for CSV output, using the fewest digits that represent it exactly
+func formatRawTime(raw *float64) string {
+	if raw == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*raw, 'f', -1, 64)
+}
+
+// This function formats a Mac absolute time for CSV output, which is empty if it wasn't recorded
+func formatMacTime(seconds *int64) string {
+	if seconds == nil {
+		return ""
+	}
+	return strconv.FormatInt(*seconds, 10)
+}
+
+// This function formats a value's entropy for CSV output, which is empty if it wasn't worked out
+func formatEntropy(entropy *float64) string {
+	if entropy == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*entropy, 'f', -1, 64)
+}
+
+// This function formats a name or value length for CSV output, which is empty if it wasn't recorded
+func formatLength(length *int) string {
+	if length == nil {
+		return ""
+	}
+	return strconv.Itoa(*length)
+}
+
+// This method will take a slice of cookie objects and output the data in CSV format. Handy for piping into a CSV file for analysis
+func outputAsCSV(w io.Writer, cookies []cookie) error {
+	result := csvRecords(cookies)
+
+	// Excel only reads a CSV as UTF-8 if it starts with a byte order mark, and prefers Windows line endings
+	if *excel {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = *excel
+
+	for _, record := range result {
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	// The footer lets the receiving end check that no rows were lost. It is a comment rather than a record, and is left
+	// out by default as strict CSV parsers reject it
+	if *csvFooter {
+		lineEnding := "\n"
+		if *excel {
+			lineEnding = "\r\n"
+		}
+		if _, err := fmt.Fprintf(w, "# rows: %d%s", len(cookies), lineEnding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function takes a slice of cookies and prints them as tab separated values, with the same header and columns as CSV.
+// Rather than quoting, backslashes, tabs, newlines, and carriage returns in the values are escaped as \\, \t, \n, and
+// \r, so every line is one record and splitting on tabs always gives the columns
+func outputAsTSV(w io.Writer, cookies []cookie) error {
+	escaper := strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+	bw := bufio.NewWriter(w)
+	for _, record := range csvRecords(cookies) {
+		for i := range record {
+			record[i] = escaper.Replace(record[i])
+		}
+		if _, err := bw.WriteString(strings.Join(record, "\t") + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// This function returns the CSV (and TSV) header followed by a record for each cookie
+func csvRecords(cookies []cookie) [][]string {
+	var result [][]string
+	columns := csvColumns(cookies)
+
+	var headers []string
+	for _, column := range columns {
+		if renamed, ok := fieldRenames[column.header]; ok {
+			headers = append(headers, renamed)
+		} else {
+			headers = append(headers, column.header)
+		}
+	}
+	result = append(result, headers)
+
+	for i := 0; i < len(cookies); i++ {
+		var row []string
+		for _, column := range columns {
+			row = append(row, column.value(cookies[i]))
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// An xlsxCell is a single cell of xlsx output: either a string, or a date (when date is set)
+type xlsxCell struct {
+	text string
+	date time.Time
+}
+
+// The fixed parts of an xlsx file (a zip of XML files). The styles give cell style 1 a built in date and time format
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Cookies" sheetId="1" r:id="rId1"/></sheets>` +
+		`<definedNames><definedName name="_xlnm._FilterDatabase" localSheetId="0" hidden="1">Cookies!$A$1:$A$1</definedName></definedNames>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+// This function takes a slice of cookies and writes them out as an Excel workbook, with a header row that stays in view
+// when scrolling and has a filter on each column. The timestamps are real dates rather than text, so they can be sorted
+// and filtered as dates (session cookies have the -session-label instead). The file is written by hand, as a zip of the
+// few XML parts Excel needs, so no dependencies are needed
+func outputAsXLSX(w io.Writer, cookies []cookie) error {
+	headers := []string{"name", "value", "domain", "path", "expires", "lastAccessed", "flags"}
+	withSource := false
+	for i := 0; i < len(cookies); i++ {
+		withSource = withSource || cookies[i].Source != ""
+	}
+	if withSource {
+		headers = append(headers, "source")
+	}
+
+	rows := [][]xlsxCell{}
+	var headerRow []xlsxCell
+	for _, header := range headers {
+		headerRow = append(headerRow, xlsxCell{text: header})
+	}
+	rows = append(rows, headerRow)
+	for i := 0; i < len(cookies); i++ {
+		expires := xlsxCell{date: cookies[i].expiresTime}
+		if cookies[i].Session {
+			expires = xlsxCell{text: cookies[i].Expires}
+		}
+		row := []xlsxCell{
+			{text: cookies[i].Name},
+			{text: cookies[i].Value},
+			{text: cookies[i].Domain},
+			{text: cookies[i].Path},
+			expires,
+			{date: cookies[i].lastAccessedTime},
+			{text: cookies[i].Flags},
+		}
+		if withSource {
+			row = append(row, xlsxCell{text: cookies[i].Source})
+		}
+		rows = append(rows, row)
+	}
+
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		content := part.content
+		if part.name == "xl/workbook.xml" {
+			content = strings.Replace(content, "$A$1:$A$1", "$A$1:$"+xlsxColumn(len(headers)-1)+"$"+strconv.Itoa(len(rows)), 1)
+		}
+		if err := writeZipFile(zw, part.name, []byte(content)); err != nil {
+			return err
+		}
+	}
+	if err := writeZipFile(zw, "xl/worksheets/sheet1.xml", xlsxSheet(rows, len(headers))); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// This function returns the XML of the worksheet holding rows, with the top row frozen and an auto filter over every column
+func xlsxSheet(rows [][]xlsxCell, columns int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	buf.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	buf.WriteString(`<sheetData>`)
+	for r, row := range rows {
+		fmt.Fprintf(&buf, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			if cell.date.IsZero() {
+				fmt.Fprintf(&buf, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+				xml.EscapeText(&buf, []byte(cell.text))
+				buf.WriteString(`</t></is></c>`)
+			} else {
+				fmt.Fprintf(&buf, `<c r="%s" s="1"><v>%s</v></c>`, ref, strconv.FormatFloat(xlsxDate(cell.date), 'f', -1, 64))
+			}
+		}
+		buf.WriteString(`</row>`)
+	}
+	buf.WriteString(`</sheetData>`)
+	fmt.Fprintf(&buf, `<autoFilter ref="A1:%s%d"/>`, xlsxColumn(columns-1), len(rows))
+	buf.WriteString(`</worksheet>`)
+	return buf.Bytes()
+}
+
+// This function converts a time to an Excel date: the number of days since 1899-12-30, with the time of day as the
+// fraction. Excel dates have no timezone, so the time is converted as it reads in its own location
+func xlsxDate(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	return float64(wall.Unix())/86400 + 25569
 }
 
-type page struct {
-	rawBytes         []byte
-	numCookiesInPage uint64
-	cookieOffsets    []uint64
-	cookies          []cookie
+// This function returns the letters Excel uses for a column, counting from 0 (so 0 is A, 25 is Z, and 26 is AA)
+func xlsxColumn(index int) string {
+	name := ""
+	for index >= 0 {
+		name = string(rune('A'+index%26)) + name
+		index = index/26 - 1
+	}
+	return name
 }
 
-type cookie struct {
-	rawBytes     []byte
-	Size         uint64 `json:"size" xml:"Size"`
-	Name         string `json:"name" xml:"Name"`
-	Value        string `json:"value" xml:"Value"`
-	Domain       string `json:"domain" xml:"Domain"`
-	Path         string `json:"path" xml:"Path"`
-	Flags        string `json:"flags" xml:"Flags"`
-	Expires      string `json:"expires" xml:"Expires"`
-	LastAccessed string `json:"lastAccessed" xml:"LastAccessed"`
+// This function adds a file to a zip archive
+func writeZipFile(zw *zip.Writer, name string, content []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	return err
 }
 
-// Command line flag variables
-var file = flag.String("i", "", "path to the binary cookies file")
-var version = flag.Bool("v", false, "display version number")
-var debug = flag.Bool("d", false, "display debugging information")
-var format = flag.String("f", "table", "format of output [table|list|json|csv|xml]")
+// This function checks the name and value of each cookie for bytes that aren't valid UTF-8 (e.g. raw binary values). An
+// invalid name or value is base64 encoded, and its NameEncoding or ValueEncoding is set to "base64" so consumers know to
+// decode it. The other is left as it is
+func encodeInvalidUTF8(cookies []cookie) {
+	for i := 0; i < len(cookies); i++ {
+		if !utf8.ValidString(cookies[i].Name) {
+			if *debug {
+				debugf("Cookie %d has a name that isn't valid UTF-8, base64 encoding it\n", i+1)
+			}
+			cookies[i].Name = base64.StdEncoding.EncodeToString([]byte(cookies[i].Name))
+			cookies[i].NameEncoding = "base64"
+		}
+		if !utf8.ValidString(cookies[i].Value) {
+			if *debug {
+				debugf("Cookie %d has a value that isn't valid UTF-8, base64 encoding it\n", i+1)
+			}
+			cookies[i].Value = base64.StdEncoding.EncodeToString([]byte(cookies[i].Value))
+			cookies[i].ValueEncoding = "base64"
+		}
+	}
+}
 
-func main() {
-	parseComLineFlags()
+// This function returns a *binarycookies.ParseError naming the first cookie with a name, value, domain, or path that isn't
+// valid UTF-8, and where it is in the file, for -strict-utf8. Pipelines that need clean UTF-8 can then fail, rather than
+// getting base64 or replacement characters
+func checkStrictUTF8(cookies []cookie) error {
+	for i := 0; i < len(cookies); i++ {
+		fields := []struct{ name, value string }{
+			{"name", cookies[i].Name},
+			{"value", cookies[i].Value},
+			{"domain", cookies[i].Domain},
+			{"path", cookies[i].Path},
+		}
+		for _, field := range fields {
+			if !utf8.ValidString(field.value) {
+				msg := fmt.Sprintf("cookie %q on %q has a %s that isn't valid UTF-8: %q", cookies[i].Name, cookies[i].Domain, field.name, field.value)
+				if cookies[i].Source != "" {
+					// With -backup the offset is in the cookie's own file
+					msg = fmt.Sprintf("%s: %s", cookies[i].Source, msg)
+				}
+				return &binarycookies.ParseError{Offset: cookies[i].offset, Page: cookies[i].page, Cookie: cookies[i].number, Msg: msg}
+			}
+		}
+	}
+	return nil
+}
 
-	data, err := ioutil.ReadFile(*file)
-	handleError(err)
+// This function encodes cookies as a binary cookies file (with the -magic signature), all in a single page. It is the
+// reverse of parseCookies: the names, values, domains, paths, flags, and timestamps it writes decode back to the same
+// cookies, which is what -selftest checks. The footer after the pages is left as zeros
+func encodeBinaryCookies(cookies []cookie) []byte {
+	var records [][]byte
+	for i := 0; i < len(cookies); i++ {
+		records = append(records, encodeCookie(cookies[i]))
+	}
 
-	checkFileMagicNumber(data)
+	// The page starts with its header, the cookie count, and an offset to each cookie, ending with a 00000000 terminator
+	pageHeaderSize := 4 + 4 + 4*len(records) + 4
+	page := []byte{0x00, 0x00, 0x01, 0x00}
+	page = binary.LittleEndian.AppendUint32(page, uint32(len(records)))
+	offset := pageHeaderSize
+	for _, record := range records {
+		page = binary.LittleEndian.AppendUint32(page, uint32(offset))
+		offset += len(record)
+	}
+	page = binary.LittleEndian.AppendUint32(page, 0)
+	for _, record := range records {
+		page = append(page, record...)
+	}
 
-	// The data is provided to extractPages which returns a new pages object populated with the pages
-	pages := extractPages(data)
+	data := []byte(*magic)
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(page)))
+	data = append(data, page...)
+	return append(data, make([]byte, 8)...)
+}
 
-	// Next, the pages reference is passed to extractCookiesFromPages, which extracts the cookies from the pages page objects
-	// extractCookiesFromPages modifies the objects the reference passes to, so it doesn't need to return anything
-	extractCookiesFromPages(pages)
+// This function encodes a single cookie record: the fixed 56 byte header (size, flags, string offsets, and timestamps)
+// followed by the null terminated domain, name, path, and value. A deleted cookie's value offset is the end of the record
+func encodeCookie(c cookie) []byte {
+	var strs []byte
+	var offsets [4]uint32
+	for i, str := range []string{c.Domain, c.Name, c.Path, c.Value} {
+		if i == 3 && c.Deleted {
+			break
+		}
+		offsets[i] = uint32(56 + len(strs))
+		strs = append(append(strs, str...), 0)
+	}
+	size := 56 + len(strs)
+	if c.Deleted {
+		offsets[3] = uint32(size)
+	}
 
-	// This variable will hold all the decoded cookies for later use
-	var allCookies []cookie
+	record := binary.LittleEndian.AppendUint32(nil, uint32(size))
+	record = binary.LittleEndian.AppendUint32(record, 0)
+	record = binary.LittleEndian.AppendUint32(record, cookieFlagBits(c))
+	record = binary.LittleEndian.AppendUint32(record, 0)
+	for _, offset := range offsets {
+		record = binary.LittleEndian.AppendUint32(record, offset)
+	}
+	record = append(record, make([]byte, 8)...)
+	record = binary.LittleEndian.AppendUint64(record, math.Float64bits(encodeCoreDataTime(c.expiresTime)))
+	record = binary.LittleEndian.AppendUint64(record, math.Float64bits(encodeCoreDataTime(c.lastAccessedTime)))
+	return append(record, strs...)
+}
 
-	// At this point, the pages have been extracted, and the cookies extracted from the pages, so last step is to just
-	// decode the cookies in each page
-	decodeCookies(pages, &allCookies)
+// This function returns the flag bits for a cookie's decoded flags. Flags that decoded as Unknown have no text to go by,
+// so their bits are copied from the cookie's raw bytes
+func cookieFlagBits(c cookie) uint32 {
+	switch c.Flags {
+	case "None":
+		return 0
+	case "Secure":
+		return 1
+	case "HttpOnly":
+		return 4
+	case "Secure; HttpOnly":
+		return 5
+	}
+	if len(c.rawBytes) >= 12 {
+		return binary.LittleEndian.Uint32(c.rawBytes[8:12])
+	}
+	return 0
+}
 
-	// Based on the format, output the cookie data
-	switch *format {
-	case "table":
-		outputAsTable(allCookies)
-	case "list":
-		outputAsList(allCookies)
-	case "json":
-		outputAsJSON(allCookies)
-	case "csv":
-		outputAsCSV(allCookies)
-	case "xml":
-		outputAsXML(allCookies)
-	default:
-		fmt.Printf("This should never run\n")
+// This function is the reverse of convertHexToCoreDataTime, turning a time back into the seconds stored in the file
+func encodeCoreDataTime(t time.Time) float64 {
+	if *epoch == "unix" {
+		return float64(t.Unix())
 	}
+	return float64(t.Unix() - 978307200)
 }
 
-// This function takes a slice of cookies and prints them out in a table format
-func outputAsTable(cookies []cookie) {
-	for i := 0; i < len(cookies); i++ {
-		fmt.Printf("Cookie %d: %s=", i+1, cookies[i].Name)
-		fmt.Printf("%s; ", cookies[i].Value)
-		fmt.Printf("Domain: %s; ", cookies[i].Domain)
-		fmt.Printf("Path: %s; ", cookies[i].Path)
-		fmt.Printf("Expires: %v; ", cookies[i].Expires)
-		fmt.Printf("Last Accessed: %v; ", cookies[i].LastAccessed)
-		fmt.Printf("%s\n", cookies[i].Flags)
+// This function decodes data, encodes the cookies again with encodeBinaryCookies, decodes that, and checks that every
+// cookie came back the same. PASS or FAIL (with the first difference) is printed, and an error is returned on FAIL so the
+// exit status is non-zero
+func runSelfTest(w io.Writer, data []byte) error {
+	original, err := parseCookies(data)
+	if err != nil {
+		return err
+	}
+	roundTripped, err := parseCookies(encodeBinaryCookies(original))
+	if err != nil {
+		return err
+	}
+
+	if len(roundTripped) != len(original) {
+		fmt.Fprintf(w, "FAIL: %d cookies were decoded, but %d came back after encoding them\n", len(original), len(roundTripped))
+		return errors.New("self-test failed")
 	}
+	for i := 0; i < len(original); i++ {
+		a, b := original[i], roundTripped[i]
+		fields := []struct{ name, before, after string }{
+			{"name", a.Name, b.Name},
+			{"value", a.Value, b.Value},
+			{"domain", a.Domain, b.Domain},
+			{"path", a.Path, b.Path},
+			{"flags", a.Flags, b.Flags},
+			{"expires", a.Expires, b.Expires},
+			{"lastAccessed", a.LastAccessed, b.LastAccessed},
+			{"deleted", strconv.FormatBool(a.Deleted), strconv.FormatBool(b.Deleted)},
+		}
+		for _, field := range fields {
+			if field.before != field.after {
+				fmt.Fprintf(w, "FAIL: cookie %d (%s): %s was %q, but came back as %q\n", i+1, a.Name, field.name, field.before, field.after)
+				return errors.New("self-test failed")
+			}
+		}
+	}
+	_, err = fmt.Fprintf(w, "PASS: all %d cookies decoded the same after encoding them again\n", len(original))
+	return err
 }
 
-// This function takes a slice of cookies and prints them out in a list format
-func outputAsList(cookies []cookie) {
+// A decodeStats summarizes the cookies decoded in a run, for the summary printed at the end of a -d run
+type decodeStats struct {
+	cookies int
+	domains map[string]bool
+	paths   map[string]bool
+	names   map[string]bool
+	largest cookie
+}
+
+// This function builds the stats for the cookies decoded in a run. They are worked out from the cookies rather than kept
+// as each file is parsed, so parsing a file more than once (as -selftest does) doesn't count its cookies twice
+func buildDecodeStats(cookies []cookie) decodeStats {
+	var s decodeStats
 	for i := 0; i < len(cookies); i++ {
-		fmt.Printf("Name: %s\n", cookies[i].Name)
-		fmt.Printf("Value: %s\n", cookies[i].Value)
-		fmt.Printf("Domain: %s\n", cookies[i].Domain)
-		fmt.Printf("Path: %s\n", cookies[i].Path)
-		fmt.Printf("Expires: %v\n", cookies[i].Expires)
-		fmt.Printf("Last Accessed: %v\n", cookies[i].LastAccessed)
-		fmt.Printf("Flags: %s\n\n", cookies[i].Flags)
+		s.record(cookies[i])
 	}
+	return s
 }
 
-// This function takes a slice of cookies and prints them out as a XML chunk
-func outputAsXML(cookies []cookie) {
-	type Nesting struct {
-		XMLName xml.Name `xml:"Cookies"`
-		Cookie  []cookie
+// This method adds a decoded cookie to the stats
+func (s *decodeStats) record(c cookie) {
+	if s.domains == nil {
+		s.domains, s.paths, s.names = make(map[string]bool), make(map[string]bool), make(map[string]bool)
 	}
+	s.cookies++
+	s.domains[c.Domain] = true
+	s.paths[c.Path] = true
+	s.names[c.Name] = true
+	if s.cookies == 1 || c.Size > s.largest.Size {
+		s.largest = c
+	}
+}
 
-	nesting := &Nesting{}
-	nesting.Cookie = cookies
-
-	out, _ := xml.MarshalIndent(nesting, "", "	")
-	fmt.Println(xml.Header + string(out))
+// This method writes a summary of the stats to w. It is given stderr, so piped output isn't affected
+func (s *decodeStats) print(w io.Writer) {
+	if structuredDebug() {
+		debugEvent("summary", map[string]interface{}{
+			"cookies": s.cookies, "domains": len(s.domains), "paths": len(s.paths), "names": len(s.names),
+			"largestName": s.largest.Name, "largestDomain": s.largest.Domain, "largestSize": s.largest.Size,
+		})
+		return
+	}
+	fmt.Fprintf(w, "[DEBUG] Decoded %d cookies: %d unique domains, %d unique paths, %d unique names\n", s.cookies, len(s.domains), len(s.paths), len(s.names))
+	if s.cookies > 0 {
+		fmt.Fprintf(w, "[DEBUG] Largest cookie: %s (%s) at %d bytes\n", s.largest.Name, s.largest.Domain, s.largest.Size)
+	}
 }
 
-// This function takes a slice of cookies and prints them out as a JSON chunk
-func outputAsJSON(cookies []cookie) {
-	marshalled, _ := json.Marshal(cookies)
-	fmt.Println(string(marshalled))
+// Helper method to convert time.Time type to string type (to ease output formatting)
+func convertCoreDataToString(time time.Time) string {
+	return time.String()
 }
 
-// This method will take a slice of cookie objects and output the data in CSV format. Handy for piping into a CSV file for analysis
-func outputAsCSV(cookies []cookie) {
-	// First, create the records as a [][]string
-	var result [][]string
-	headers := []string{"name", "value", "domain", "path", "expires", "lastAccessed", "flags"}
-	result = append(result, headers)
+func parseComLineFlags() {
+	flag.Usage = printHelp
+	flag.Parse()
 
-	for i := 0; i < len(cookies); i++ {
-		var row []string
-		row = append(row, cookies[i].Name)
-		row = append(row, cookies[i].Value)
-		row = append(row, cookies[i].Domain)
-		row = append(row, cookies[i].Path)
-		row = append(row, cookies[i].Expires)
-		row = append(row, cookies[i].LastAccessed)
-		row = append(row, cookies[i].Flags)
-		result = append(result, row)
+	if *dumpFlags {
+		handleError(printFlags(os.Stdout))
+		os.Exit(0)
 	}
 
-	w := csv.NewWriter(os.Stdout)
+	if *version {
+		fmt.Println("BinaryCookieExtractor (" + Version() + ") - @KittyNighthawk (2021)")
+		os.Exit(1)
+	}
 
-	for _, record := range result {
-		err := w.Write(record)
-		handleError(err)
+	if *file == "" && *backup == "" && *hexInput == "" {
+		fmt.Println("No parameters supplied!")
+		printUsageInstructions()
+		os.Exit(1)
 	}
 
-	w.Flush()
+	if *backup != "" && *file != "" {
+		if *debug {
+			debugf("-i and -backup each give the input to decode, so only one of them can be used\n")
+		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-	if err := w.Error(); err != nil {
-		handleError(err)
+	if *backup != "" && (*offset != "" || *length != "") {
+		if *debug {
+			debugf("-offset and -length pick out part of a single file, so can't be used with -backup\n")
+		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-}
 
-// This function takes a pages object and will decode the cookies within the individual pages. Nothing is returned as it
-// modifies the objects the pages reference points to
-func decodeCookies(pages pages, allCookies *[]cookie) {
-	// First, loop through the pages
-	for i := 0; i < len(pages.pages); i++ {
-		// Now, loop through the cookies within each page
-		for j := 0; j < len(pages.pages[i].cookies); j++ {
-			// And here you can access each cookie object individually, so decode them and update each cookies instance variables
-			// Decode size of individual cookies
-			a := pages.pages[i].cookies[j].rawBytes[:4]
-			intA := int(convertHexToUint(reverseByteSlice(a)))
-			pages.pages[i].cookies[j].Size = uint64(intA)
-
-			// Decode the flags of individual cookies
-			// Cookie flag decodings
-			// 0x0 - no cookie flags
-			// 0x1 - secure flag only
-			// 0x4 - httponly flag only
-			// 0x5 - secure + httponly flags set
-			b := int(convertHexToUint(reverseByteSlice(pages.pages[i].cookies[j].rawBytes[8:12])))
-			var flagText string
-			switch b {
-			case 0:
-				flagText = "None"
-			case 1:
-				flagText = "Secure"
-			case 4:
-				flagText = "HttpOnly"
-			case 5:
-				flagText = "Secure; HttpOnly"
-			default:
-				flagText = "Unknown"
-			}
-			pages.pages[i].cookies[j].Flags = flagText
-
-			// Determine offsets for the other values (needed to know where to carve values from)
-			domainOffset := convertHexToUint(reverseByteSlice(pages.pages[i].cookies[j].rawBytes[16:20])) // 4 byte field
-			nameOffset := convertHexToUint(reverseByteSlice(pages.pages[i].cookies[j].rawBytes[20:24]))   // 4 byte field
-			pathOffset := convertHexToUint(reverseByteSlice(pages.pages[i].cookies[j].rawBytes[24:28]))   // 4 byte field
-			valueOffset := convertHexToUint(reverseByteSlice(pages.pages[i].cookies[j].rawBytes[28:32]))  // 4 byte field
-
-			// Carve the values from the raw cookie bytes using the above offsets, and set the cookie instance variables to the carved values
-			// Each value is null terminated and variable in length, so scanUntilNullByte grabs everything from the offset until it sees 0x00
-			pages.pages[i].cookies[j].Name = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[nameOffset:]))
-			pages.pages[i].cookies[j].Value = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[valueOffset:]))
-			pages.pages[i].cookies[j].Domain = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[domainOffset:]))
-			pages.pages[i].cookies[j].Path = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[pathOffset:]))
-
-			// Now for the timestamps. These are big-endian double precision (or float64 in Go) values of Cocoa Core Data epochs
-			expiresRaw := pages.pages[i].cookies[j].rawBytes[40:48]      // 8 byte field
-			lastAccessedRaw := pages.pages[i].cookies[j].rawBytes[48:56] // 8 byte field
-			pages.pages[i].cookies[j].Expires = convertCoreDataToString(convertHexToCoreDataTime(expiresRaw))
-			pages.pages[i].cookies[j].LastAccessed = convertCoreDataToString(convertHexToCoreDataTime(lastAccessedRaw))
-
-			// Build up an cookie object and put it into the cookies slice
-			var aCookie cookie
-			aCookie.rawBytes = pages.pages[i].cookies[j].rawBytes
-			aCookie.Size = uint64(intA)
-			aCookie.Name = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[nameOffset:]))
-			aCookie.Value = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[valueOffset:]))
-			aCookie.Domain = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[domainOffset:]))
-			aCookie.Path = string(scanUntilNullByte(pages.pages[i].cookies[j].rawBytes[pathOffset:]))
-			aCookie.Flags = flagText
-			aCookie.Expires = convertCoreDataToString(convertHexToCoreDataTime(expiresRaw))
-			aCookie.LastAccessed = convertCoreDataToString(convertHexToCoreDataTime(lastAccessedRaw))
-
-			// Put the cookie object into the global cookies slice
-			*allCookies = append(*allCookies, aCookie)
-		}
-	}
-}
-
-// This function pages a pages object and extracts the cookies from each page within the pages object into cookie objects.
-// No cookie decoding is done here, this just gets the raw cookie bytes out for later decoding
-func extractCookiesFromPages(pages pages) {
-	// Loop through each page
-	for i := 0; i < len(pages.pages); i++ {
-		// First, get the number of cookies in the current page
-		a, _ := strconv.ParseUint(hex.EncodeToString(reverseByteSlice(pages.pages[i].rawBytes[4:8])), 10, 64)
-		pages.pages[i].numCookiesInPage = a
+	if *watch && (*file == "" || *file == "-" || strings.HasPrefix(*file, "http://") || strings.HasPrefix(*file, "https://") || *pageOutput) {
 		if *debug {
-			fmt.Printf("[DEBUG] Number of cookies in page (%d): %d\n", i+1, pages.pages[i].numCookiesInPage)
+			debugf("-watch needs -i to be a local file, and can't be used with -page-output\n")
 		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-		// Next, get the offsets for the cookies (loop numCookiesInPage times)
-		startOffset, endOffset := 8, 12
-		for j := 0; j < int(pages.pages[i].numCookiesInPage); j++ {
-			cookieLen := convertHexToUint(reverseByteSlice(pages.pages[i].rawBytes[startOffset:endOffset]))
-			pages.pages[i].cookieOffsets = append(pages.pages[i].cookieOffsets, cookieLen)
-			startOffset += 4
-			endOffset += 4
+	if !isValidFormat(*format) {
+		if *debug {
+			debugf("*format does not equal %s\n", strings.Join(formats, ", "))
+			debugf("*format: %s\n", *format)
 		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-		// Next, extract the raw cookies (in byte slices) from the current page using the offsets from above
-		for k := 0; k < len(pages.pages[i].cookieOffsets); k++ {
-			// For last cookie, just go from last offset to end of rawBytes; otherwise, use the offsets
-			if k == len(pages.pages[i].cookieOffsets)-1 {
-				var newCookie cookie
-				if *debug {
-					fmt.Printf("[DEBUG] Loop check (Page: %d): k=%v, len()=%v (Value: %v)\n", i, k, len(pages.pages[i].cookieOffsets)-1, pages.pages[i].cookieOffsets)
-				}
-				newCookie.rawBytes = pages.pages[i].rawBytes[int(pages.pages[i].cookieOffsets[k]):]
-				pages.pages[i].cookies = append(pages.pages[i].cookies, newCookie)
-			} else {
-				var newCookie cookie
-				if *debug {
-					fmt.Printf("[DEBUG] Loop check (Page: %d): k=%v, len()=%v (Value: %v)\n", i, k, len(pages.pages[i].cookieOffsets)-1, pages.pages[i].cookieOffsets)
-				}
-				newCookie.rawBytes = pages.pages[i].rawBytes[int(pages.pages[i].cookieOffsets[k]):int(pages.pages[i].cookieOffsets[k+1])]
-				pages.pages[i].cookies = append(pages.pages[i].cookies, newCookie)
-			}
+	if *sortBy != "" && *sortBy != "name" && *sortBy != "domain" && *sortBy != "path" && *sortBy != "expires" && *sortBy != "creation" {
+		if *debug {
+			debugf("*sortBy does not equal name, domain, path, expires, or creation\n")
+			debugf("*sortBy: %s\n", *sortBy)
 		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	// At this point, the pages objects contain page objects, and the page objects contain raw cookies. Next is to decode the cookies
-}
 
-// This function takes a byte array (the contents of te file) and populates the pages struct with values from the data
-func extractPages(data []byte) pages {
-	var pages pages
-	pages.numPages = convertHexToUint(data[4:8])
-	if *debug {
-		fmt.Printf("[DEBUG] Number of pages: %d\n", pages.numPages)
+	if *bucket != "month" && *bucket != "year" {
+		if *debug {
+			debugf("*bucket does not equal month or year\n")
+			debugf("*bucket: %s\n", *bucket)
+		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	pages.pageSizes = parseSizeOfPages(data, pages.numPages)
-	pages.headerSize = pages.numPages*4 + 8
-	if *debug {
-		fmt.Printf("[DEBUG] Size of header: %d bytes\n", pages.headerSize)
+
+	if *splitBy != "" && (*splitBy != "domain" || *outputPath == "") {
+		if *debug {
+			debugf("*splitBy does not equal domain, or no -o directory was given\n")
+			debugf("*splitBy: %s, *outputPath: %s\n", *splitBy, *outputPath)
+		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
 
-	var offsetCounter uint64
-	// Need to extract each page to a new page object, then store those page objects within pages pages []page variable
-	for i := 0; i < len(pages.pageSizes); i++ {
-		var page page
+	if *headerOnly && (*backup != "" || *split) {
+		if *debug {
+			debugf("-header-only checks a single file, so can't be used with -backup or -split\n")
+		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-		if i == len(pages.pageSizes)-1 {
-			// You're at the last offset in pageSizes, so just slice to the end of data
-			page.rawBytes = data[pages.headerSize+offsetCounter:]
-		} else {
-			// There's another offset after the current one in pageSizes, so use the offsets to determine where to slice
-			page.rawBytes = data[pages.headerSize+offsetCounter : pages.headerSize+pages.pageSizes[i]]
-			offsetCounter += pages.pageSizes[i]
+	if *format == "meta" && (*backup != "" || *split || *splitBy != "") {
+		if *debug {
+			debugf("-f meta describes a single file, so can't be used with -backup, -split, or -split-by\n")
 		}
-		pages.pages = append(pages.pages, page)
+		printUsageInstructions()
+		os.Exit(1)
+	}
+
+	if *merge != "" && *merge != "newest" {
 		if *debug {
-			fmt.Printf("[DEBUG] Value of rawBytes in page %d: %v\n", i+1, page.rawBytes)
+			debugf("*merge does not equal newest\n")
+			debugf("*merge: %s\n", *merge)
 		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	return pages
-}
 
-// This function scan a byte slice until it finds the first instance of a null byte (0x00). It then returns a new slice
-// from the beginning of data to the byte before the first null byte
-func scanUntilNullByte(data []byte) []byte {
-	var result []byte
-	for i := 0; i < len(data); i++ {
-		if data[i] == 0 {
-			break
-		} else {
-			result = append(result, data[i])
+	if *pageSizeHeader != "auto" && *pageSizeHeader != "yes" && *pageSizeHeader != "no" {
+		if *debug {
+			debugf("*pageSizeHeader does not equal auto, yes, or no\n")
+			debugf("*pageSizeHeader: %s\n", *pageSizeHeader)
 		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	return result
-}
 
-// This function takes a byte slice and reverses the order of bytes (useful for converting between little and big endian)
-func reverseByteSlice(data []byte) []byte {
-	var result []byte
-	for i := len(data) - 1; i >= 0; i-- {
-		result = append(result, data[i])
+	if len(*magic) != 4 {
+		if *debug {
+			debugf("*magic is not 4 bytes\n")
+			debugf("*magic: %q\n", *magic)
+		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	return result
-}
 
-// This function takes the file data and the number of pages. It returns a uint64 array containing the size (in decimal) of each page
-func parseSizeOfPages(data []byte, pages uint64) []uint64 {
-	startOffset, endOffset := 8, 12
-	var result []uint64
+	if *colorMode != "auto" && *colorMode != "always" && *colorMode != "never" {
+		if *debug {
+			debugf("*colorMode does not equal auto, always, or never\n")
+			debugf("*colorMode: %s\n", *colorMode)
+		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-	for i := 0; i < int(pages); i++ {
-		pageSize := convertHexToUint(data[startOffset:endOffset])
-		startOffset += 4
-		endOffset += 4
-		result = append(result, pageSize)
+	if n, err := strconv.Atoi(*truncate); *truncate != "" && *truncate != "auto" && (err != nil || n <= 0) {
 		if *debug {
-			fmt.Printf("[DEBUG] Size of page %d: %d bytes\n", i+1, pageSize)
+			debugf("*truncate is not a positive number or auto\n")
+			debugf("*truncate: %s\n", *truncate)
 		}
+		printUsageInstructions()
+		os.Exit(1)
 	}
-	return result
-}
 
-// This function converts a byte slice (like [00 00 02 2b]) to its Uint64 equivalent (like 555)
-func convertHexToUint(bytes []byte) uint64 {
-	a := hex.EncodeToString(bytes)
-	b, _ := strconv.ParseUint(a, 16, 64)
-	return b
-}
+	if *epoch != "coredata" && *epoch != "unix" {
+		if *debug {
+			debugf("*epoch does not equal coredata or unix\n")
+			debugf("*epoch: %s\n", *epoch)
+		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
 
-// This function takes a hexadecimal byte slice containing a Cocoa Core Data epoch time and returns a string of the human-readable
-// time
-func convertHexToCoreDataTime(bytes []byte) time.Time {
-	a := hex.EncodeToString(reverseByteSlice(bytes))
-	b, _ := strconv.ParseUint(a, 16, 64)
-	c := math.Float64frombits(b)
-	d := int64(c)
-	// Different between UNIX and Core Data epoch is: UNIX - 978307200 = Core Data
-	e := time.Unix(d+978307200, 0)
-	return e
-}
+	if *templateText != "" && *templateFile != "" {
+		if *debug {
+			debugf("-template and -template-file can't both be used\n")
+		}
+		printUsageInstructions()
+		os.Exit(1)
+	}
+	if *templateText != "" || *templateFile != "" {
+		tmpl, err := parseOutputTemplate()
+		handleError(err)
+		outputTemplate = tmpl
+	}
 
-// Helper method to convert time.Time type to string type (to ease output formatting)
-func convertCoreDataToString(time time.Time) string {
-	return time.String()
-}
+	if *renameFields != "" {
+		renames, err := parseFieldRenames(*renameFields)
+		handleError(err)
+		fieldRenames = renames
+	}
 
-func parseComLineFlags() {
-	flag.Parse()
+	if !strings.EqualFold(*timezone, "local") {
+		location, err := time.LoadLocation(*timezone)
+		if err != nil {
+			if *debug {
+				debugf("-timezone: %v\n", err)
+			}
+			printUsageInstructions()
+			os.Exit(1)
+		}
+		splitLocation = location
+	}
 
-	if *version {
-		fmt.Println("BinaryCookieExtractor (v1.0) - @KittyNighthawk (2021)")
+	if *jsonKeys != "camel" && *jsonKeys != "snake" {
+		if *debug {
+			debugf("*jsonKeys does not equal camel or snake\n")
+			debugf("*jsonKeys: %s\n", *jsonKeys)
+		}
+		printUsageInstructions()
 		os.Exit(1)
 	}
 
-	if *file == "" {
-		fmt.Println("No parameters supplied!")
+	if *retention && *format != "table" && *format != "json" {
+		if *debug {
+			debugf("-retention can only be output as a table or JSON (-f table or -f json)\n")
+		}
 		printUsageInstructions()
 		os.Exit(1)
 	}
 
-	if *format != "table" && *format != "list" && *format != "json" && *format != "csv" && *format != "xml" {
+	if *statsPerFile && *format != "table" && *format != "json" {
 		if *debug {
-			fmt.Printf("[DEBUG] *format does not equal table, list, json, csv, or xml\n")
-			fmt.Printf("[DEBUG] *format: %s\n", *format)
+			debugf("-stats-per-file can only be output as a table or JSON (-f table or -f json)\n")
 		}
 		printUsageInstructions()
 		os.Exit(1)
 	}
 }
 
+// The flags left out of the -h help and -dump-flags, as they are for experimenting with odd files, scripting around the
+// tool, or checking the decoder rather than everyday use
+var hiddenFlags = map[string]bool{"epoch": true, "dump-flags": true, "selftest": true}
+
+// This function prints the -h help: how to use the tool, then each flag other than those in hiddenFlags, in the same
+// layout as flag.PrintDefaults
+func printHelp() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+		// Var takes the default from the flag's current value, which may already have been set by an earlier argument
+		visible.Lookup(f.Name).DefValue = f.DefValue
+	})
+	visible.PrintDefaults()
+}
+
+// A flagInfo describes a command line flag, for -dump-flags
+type flagInfo struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+}
+
+// This function writes every flag except those in hiddenFlags to w as a JSON array, in name order. These are the same
+// flags -h shows
+func printFlags(w io.Writer) error {
+	var flags []flagInfo
+	flag.VisitAll(func(f *flag.Flag) {
+		if hiddenFlags[f.Name] {
+			return
+		}
+		// Every flag defined with the flag package's functions is a Getter, so this only falls back for ones added by
+		// other packages (e.g. the test flags when run under go test)
+		typ := fmt.Sprintf("%T", f.Value)
+		if getter, ok := f.Value.(flag.Getter); ok {
+			typ = fmt.Sprintf("%T", getter.Get())
+		}
+		flags = append(flags, flagInfo{
+			Name:    f.Name,
+			Type:    typ,
+			Default: f.DefValue,
+			Usage:   f.Usage,
+		})
+	})
+	marshalled, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(marshalled))
+	return err
+}
+
+// This function checks whether f is one of the supported output formats
+func isValidFormat(f string) bool {
+	for _, valid := range formats {
+		if f == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// The version to report when the build info doesn't have one (e.g. built from a source checkout). Release builds can set
+// it with: go build -ldflags "-X main.buildVersion=v1.1"
+var buildVersion = "v1.0"
+
+// This function returns the version of the tool. When it was installed with go install/go get, this is the module version
+// recorded in the binary's build info, otherwise it is buildVersion
+func Version() string {
+	if info, ok := runtimedebug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return buildVersion
+}
+
 func printUsageInstructions() {
-	fmt.Println(`BinaryCookieExtractor (v1.0) - Safari/iOS/iPadOS Binary Cookie Decoder - @KittyNighthawk (2021)
+	fmt.Println("BinaryCookieExtractor (" + Version() + `) - Safari/iOS/iPadOS Binary Cookie Decoder - @KittyNighthawk (2021)
 
-Usage: $ ./binary-cookie-extractor -i <BINARY-COOKIE-FILE> [-f table|list|json|csv|xml] [-d]
+Usage: $ ./binary-cookie-extractor -i <BINARY-COOKIE-FILE> | -backup <DIR> | -hex <HEX> [-f table|compact-table|list|json|csv|tsv|xml|anomalies|tree|histogram|plist|apple-cookies-plist|count-by-flag|single|keyvalue|ini|meta|influx|domains|pb|xlsx] [-json-keys camel|snake] [-limit N] [-max-value-len N] [-session-label TEXT] [-truncate N|auto] [-relative-time] [-raw-time] [-retention] [-stats-per-file] [-d]
 Example: $ ./binary-cookie-extractor -i Cookies.binarycookies
 
 For help, enter: $ ./binary-cookie-extractor -h`)
 }
 
-func handleError(err error) {
+// This function prints a warning from the decoder about something odd in the file that doesn't stop it being decoded.
+// Minor warnings are for problems the decoder works around by itself, which would be noise in normal output, so they are
+// only printed with -d
+func printWarning(w binarycookies.Warning) {
+	if !w.Minor {
+		fmt.Fprintf(os.Stderr, "[WARNING] %s\n", w.Msg)
+	} else if *debug {
+		debugf("%s\n", w.Msg)
+	}
+}
+
+// This function prints a debug message, and is only called when -d was given. With -f json, stdout is kept clean for the
+// cookies, so the message is written to stderr as a JSON object instead (like the events from debugEvent)
+func debugf(format string, args ...interface{}) {
+	message := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if structuredDebug() {
+		debugEvent("message", map[string]interface{}{"message": message})
+		return
+	}
+	fmt.Println("[DEBUG] " + message)
+}
+
+// This function returns true if debug output should be JSON, which is the case when -d is used with -f json
+func structuredDebug() bool {
+	return *debug && *format == "json"
+}
+
+// This function writes a debug event (like the layout of a page, or the offsets in a cookie) to stderr as a JSON object
+// with an "event" key naming it, so the parser's state can be analyzed by other tools. It does nothing unless
+// structuredDebug is true, as the human readable debug output covers the same ground
+func debugEvent(event string, fields map[string]interface{}) {
+	if !structuredDebug() {
+		return
+	}
+	fields["event"] = event
+	marshalled, err := json.Marshal(fields)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "An error occured: %v\n", err)
-		os.Exit(1)
+		return
 	}
+	fmt.Fprintln(os.Stderr, string(marshalled))
 }
 
-// This function checks that the file provided matches the binary cookies magic number
-func checkFileMagicNumber(data []byte) {
-	magicNum := data[:4]
-	if string(magicNum) != "cook" {
-		fmt.Fprintf(os.Stderr, "File is not a valid iOS/Safari binary cookies file... exiting\n")
-		os.Exit(1)
+// The exit statuses used for errors. Files that are missing or can't be read get their own, so scripts sweeping many
+// paths can tell them apart from files that are damaged
+const (
+	exitError            = 1
+	exitNotFound         = 3
+	exitPermissionDenied = 4
+)
+
+// This function prints err and exits, if it isn't nil. A missing file or one that can't be read (cookie files are often
+// only readable with elevated access) gets a message saying what to do about it, and its own exit status
+func handleError(err error) {
+	if err == nil {
+		return
+	}
+
+	path := ""
+	if pathErr, ok := err.(*os.PathError); ok {
+		path = pathErr.Path + ": "
+	}
+	switch {
+	case os.IsPermission(err):
+		fmt.Fprintf(os.Stderr, "An error occured: %spermission denied: run with appropriate privileges (on macOS, Safari's cookies also need Full Disk Access for the terminal)\n", path)
+		os.Exit(exitPermissionDenied)
+	case os.IsNotExist(err):
+		fmt.Fprintf(os.Stderr, "An error occured: %sfile not found: check the path\n", path)
+		os.Exit(exitNotFound)
+	}
+	fmt.Fprintf(os.Stderr, "An error occured: %v\n", err)
+	os.Exit(exitError)
+}
+
+// How often -watch checks the -i file for changes
+const watchPollInterval = 500 * time.Millisecond
+
+// This function polls the -i file, and each time its modification time or size changes (and once at the start) runs
+// this program again with the same flags minus -watch, so the cookies are decoded and output afresh. Table and list
+// output on a terminal is cleared first, while other formats get a new document after the last. Each run is a separate
+// process, so a run that fails (e.g. the file was read part way through being written) doesn't stop the watching. It
+// returns when interrupted (Ctrl-C)
+func runWatch() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "watch" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	clear := (*format == "table" || *format == "compact-table" || *format == "list") && *outputPath == "" && isTerminal(os.Stdout)
+	var last os.FileInfo
+	for {
+		info, err := os.Stat(*file)
+		if err != nil {
+			if *debug {
+				debugf("Can't check %s for changes: %v\n", *file, err)
+			}
+		} else if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			last = info
+			if clear {
+				fmt.Print("\033[H\033[2J")
+			}
+			cmd := exec.Command(executable, args...)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil && *debug {
+				debugf("Decoding %s after it changed failed: %v\n", *file, err)
+			}
+		}
+
+		select {
+		case <-interrupts:
+			return nil
+		case <-ticker.C:
+		}
 	}
 }
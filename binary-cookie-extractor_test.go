@@ -0,0 +1,822 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/KittyNighthawk/binary-cookie-extractor/binarycookies"
+)
+
+// A testCookie describes a cookie for buildCookie to encode. Times are Core Data timestamps (seconds since 2001-01-01)
+type testCookie struct {
+	name, value, domain, path string
+	flags                     uint32
+	expires, created          float64
+}
+
+// This function encodes c as a cookie record, laid out the way Safari writes them: the 56 byte header, then the domain,
+// name, path, and value, each null terminated
+func buildCookie(c testCookie) []byte {
+	var strs []byte
+	offsets := make([]uint32, 4)
+	for i, s := range []string{c.domain, c.name, c.path, c.value} {
+		offsets[i] = uint32(56 + len(strs))
+		strs = append(append(strs, s...), 0)
+	}
+
+	record := make([]byte, 56, 56+len(strs))
+	binary.LittleEndian.PutUint32(record[0:], uint32(56+len(strs)))
+	binary.LittleEndian.PutUint32(record[8:], c.flags)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(record[16+i*4:], offset)
+	}
+	binary.LittleEndian.PutUint64(record[40:], math.Float64bits(c.expires))
+	binary.LittleEndian.PutUint64(record[48:], math.Float64bits(c.created))
+	return append(record, strs...)
+}
+
+// This function lays out cookie records as a page: the page header, the cookie count, an offset for each cookie, and the
+// 00000000 terminator, followed by the records
+func buildPage(records ...[]byte) []byte {
+	page := []byte{0x00, 0x00, 0x01, 0x00}
+	page = binary.LittleEndian.AppendUint32(page, uint32(len(records)))
+	offset := 8 + 4*len(records) + 4
+	for _, record := range records {
+		page = binary.LittleEndian.AppendUint32(page, uint32(offset))
+		offset += len(record)
+	}
+	page = append(page, 0, 0, 0, 0)
+	for _, record := range records {
+		page = append(page, record...)
+	}
+	return page
+}
+
+// This function puts pages together into a binary cookies file, with the header and the usual 8 byte footer
+func buildFile(pages ...[]byte) []byte {
+	data := []byte("cook")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(pages)))
+	for _, page := range pages {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(page)))
+	}
+	for _, page := range pages {
+		data = append(data, page...)
+	}
+	return append(data, make([]byte, 8)...)
+}
+
+// This function encodes c as a deleted cookie: a record with no value, whose value offset is the size of the record
+func buildTombstone(c testCookie) []byte {
+	record := buildCookie(c)
+	record = record[:len(record)-len(c.value)-1]
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(record)))
+	binary.LittleEndian.PutUint32(record[28:], uint32(len(record)))
+	return record
+}
+
+func TestDeletedAndEmptyValues(t *testing.T) {
+	live := buildCookie(testCookie{name: "live", value: "v", domain: "example.com", path: "/", expires: 800000000, created: 700000000})
+	empty := buildCookie(testCookie{name: "empty", value: "", domain: "example.com", path: "/", expires: 800000000, created: 700000000})
+	gone := buildTombstone(testCookie{name: "gone", domain: "example.com", path: "/", expires: 800000000, created: 700000000})
+	withoutFooter := func(data []byte) []byte { return data[:len(data)-8] }
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"in the middle of a page", buildFile(buildPage(live, gone, empty))},
+		{"last in a page", buildFile(buildPage(live, empty, gone), buildPage(live))},
+		{"last in the file", buildFile(buildPage(live, empty, gone))},
+		{"last in a file without a footer", withoutFooter(buildFile(buildPage(live, empty, gone)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookies, err := parseCookies(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range cookies {
+				switch c.Name {
+				case "gone":
+					if !c.Deleted || c.Value != "" {
+						t.Errorf("deleted cookie: got deleted %v and value %q, want true and empty", c.Deleted, c.Value)
+					}
+				case "empty":
+					if c.Deleted || c.Value != "" {
+						t.Errorf("empty cookie: got deleted %v and value %q, want false and empty", c.Deleted, c.Value)
+					}
+				case "live":
+					if c.Deleted || c.Value != "v" {
+						t.Errorf("live cookie: got deleted %v and value %q, want false and v", c.Deleted, c.Value)
+					}
+				}
+			}
+			if err := runSelfTest(io.Discard, tt.data); err != nil {
+				t.Errorf("self-test: %v", err)
+			}
+		})
+	}
+}
+
+// testdata/binary-value.binarycookies holds a cookie whose value is raw binary, one whose name has an invalid byte in
+// it, and a plain one
+func TestEncodeInvalidUTF8(t *testing.T) {
+	data, err := os.ReadFile("testdata/binary-value.binarycookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := parseCookies(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeInvalidUTF8(cookies)
+
+	want := []map[string]string{
+		{"name": "binary", "value": "//4B", "nameEncoding": "", "valueEncoding": "base64"},
+		{"name": "YmFk/25hbWU=", "value": "fine", "nameEncoding": "base64", "valueEncoding": ""},
+		{"name": "plain", "value": "text", "nameEncoding": "", "valueEncoding": ""},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := outputAsJSON(&out, cookies); err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("output isn't valid JSON: %v\n%s", err, out.String())
+		}
+		for i, fields := range want {
+			for key, value := range fields {
+				// A missing key is the same as an empty one, as the encoding keys are left out when empty
+				if field, _ := got[i][key].(string); field != value {
+					t.Errorf("cookie %d: got %s %q, want %q", i+1, key, field, value)
+				}
+			}
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := outputAsCSV(&out, cookies); err != nil {
+			t.Fatal(err)
+		}
+		if !utf8.Valid(out.Bytes()) {
+			t.Fatalf("output isn't valid UTF-8:\n%s", out.String())
+		}
+		rows, err := csv.NewReader(&out).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		column := make(map[string]int)
+		for i, header := range rows[0] {
+			column[header] = i
+		}
+		for i, fields := range want {
+			for key, value := range fields {
+				if got := rows[i+1][column[key]]; got != value {
+					t.Errorf("cookie %d: got %s %q, want %q", i+1, key, got, value)
+				}
+			}
+		}
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	data, err := os.ReadFile("testdata/binary-value.binarycookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("strict-utf8", func(t *testing.T) {
+		cookies, err := parseCookies(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parseErr *binarycookies.ParseError
+		if !errors.As(checkStrictUTF8(cookies), &parseErr) {
+			t.Fatalf("got %v, want a *binarycookies.ParseError", checkStrictUTF8(cookies))
+		}
+		if parseErr.Page != 1 || parseErr.Cookie != 1 {
+			t.Errorf("got cookie %d in page %d, want cookie 1 in page 1", parseErr.Cookie, parseErr.Page)
+		}
+		// The offset should be where the cookie's record (starting with its size) is in the file
+		if size := binary.LittleEndian.Uint32(data[parseErr.Offset:]); uint64(size) != cookies[0].Size {
+			t.Errorf("offset %d points at a size of %d, want %d", parseErr.Offset, size, cookies[0].Size)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		offset     string
+		length     string
+		wantOffset int
+	}{
+		{"invalid -offset", "zz", "", -1},
+		{"invalid -length", "0", "zz", -1},
+		{"-offset past the end", strconv.Itoa(len(data) + 1), "", len(data)},
+		{"-length past the end", "8", strconv.Itoa(len(data)), len(data)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := carveInput(data, tt.offset, tt.length)
+			var parseErr *binarycookies.ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("got %v, want a *binarycookies.ParseError", err)
+			}
+			if parseErr.Offset != tt.wantOffset {
+				t.Errorf("got offset %d, want %d", parseErr.Offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestJarFilter(t *testing.T) {
+	var records [][]byte
+	for _, domain := range []string{".Example.com", "ads.example.com", "example.org", "tracker.net"} {
+		records = append(records, buildCookie(testCookie{name: "c", value: domain, domain: domain, path: "/"}))
+	}
+	j, err := binarycookies.ParseJar(bytes.NewReader(buildFile(buildPage(records...))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter jarFilter
+		want   string
+	}{
+		{"no filters", jarFilter{}, ".Example.com,ads.example.com,example.org,tracker.net"},
+		{"domain", jarFilter{domain: "example.com"}, ".Example.com"},
+		{"allow list", jarFilter{allow: []string{"*.example.com", "example.com"}, useAllow: true}, ".Example.com,ads.example.com"},
+		{"empty allow list", jarFilter{useAllow: true}, ""},
+		{"deny list", jarFilter{deny: []string{"ads.*", "tracker.net"}}, ".Example.com,example.org"},
+		{"deny takes precedence", jarFilter{allow: []string{"*example.*"}, deny: []string{"ads.*"}, useAllow: true}, ".Example.com,example.org"},
+		{"domain and deny list", jarFilter{domain: "example.com", deny: []string{"example.com"}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, c := range tt.filter.apply(j) {
+				got = append(got, c.Domain)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("got %q, want %q", strings.Join(got, ","), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteToOutputGzip(t *testing.T) {
+	defer func(old bool) { *gzipOutput = old }(*gzipOutput)
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "output\n")
+		return err
+	}
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		gzip bool
+		want bool
+	}{
+		{"out.txt", false, false},
+		{"out.txt.gz", false, true},
+		{"out.json", true, true},
+	} {
+		*gzipOutput = tt.gzip
+		path := filepath.Join(dir, tt.name)
+		if err := writeToOutput(path, write); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if (err == nil) != tt.want {
+			t.Errorf("%s with -gzip %v: got gzipped %v, want %v", tt.name, tt.gzip, err == nil, tt.want)
+			continue
+		}
+		if err == nil {
+			if data, err = io.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(data) != "output\n" {
+			t.Errorf("%s with -gzip %v: got %q, want %q", tt.name, tt.gzip, data, "output\n")
+		}
+	}
+}
+
+// A failingWriter fails every write, like a full disk or a closed pipe
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestOutputWriteErrors(t *testing.T) {
+	defer func(old string) { *format = old }(*format)
+	// The name is empty so the cookie shows up in anomalies output too
+	cookies, err := parseCookies(buildFile(buildPage(buildCookie(testCookie{value: "abc", domain: "example.com", path: "/", expires: 700000000}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range formats {
+		// This describes the file rather than the cookies, so it isn't written by writeOutput
+		if f == "meta" {
+			continue
+		}
+		*format = f
+		if err := writeOutput(failingWriter{}, cookies, nil); err == nil {
+			t.Errorf("-f %s: a failed write wasn't reported", f)
+		}
+	}
+}
+
+func TestWarningsPerParse(t *testing.T) {
+	good := buildFile(buildPage(buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/"})))
+	zeroSize := make([]byte, 56)
+	damaged := buildFile(buildPage(buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/"}), zeroSize))
+
+	// Each file's stats only count the warnings found in that file, whatever was parsed before it
+	for _, tt := range []struct {
+		data []byte
+		want int
+	}{{damaged, 1}, {good, 0}, {damaged, 1}} {
+		if row := buildFileStats("file", tt.data, nil); row.Warnings != tt.want {
+			t.Errorf("got %d warnings, want %d", row.Warnings, tt.want)
+		}
+	}
+
+	cookies, warnings, err := decodeJar(damaged, "", &jarFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, again, _ := decodeJar(damaged, "", &jarFilter{}); len(again) != len(warnings) {
+		t.Errorf("got %d warnings decoding the file a second time, want %d", len(again), len(warnings))
+	}
+	var out bytes.Buffer
+	if err := outputAsWrappedJSON(&out, cookies, warnings); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Cookies  []map[string]interface{} `json:"cookies"`
+		Warnings []string                 `json:"warnings"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output isn't valid JSON: %v\n%s", err, out.String())
+	}
+	if len(got.Cookies) != 1 || len(got.Warnings) != 1 || !strings.Contains(got.Warnings[0], "declares a size of 0") {
+		t.Errorf("got %d cookies and warnings %q, want 1 cookie and the zero size warning", len(got.Cookies), got.Warnings)
+	}
+}
+
+func TestDecodeStats(t *testing.T) {
+	data := buildFile(buildPage(
+		buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/"}),
+		buildCookie(testCookie{name: "pref", value: "a longer value", domain: "example.com", path: "/app"}),
+	))
+	cookies, err := parseCookies(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Decoding the file again (as -selftest does) mustn't change the stats for the first decode
+	if _, err := parseCookies(data); err != nil {
+		t.Fatal(err)
+	}
+
+	s := buildDecodeStats(cookies)
+	if s.cookies != 2 || len(s.domains) != 1 || len(s.paths) != 2 || len(s.names) != 2 || s.largest.Name != "pref" {
+		t.Errorf("got %d cookies, %d domains, %d paths, %d names and largest %q, want 2, 1, 2, 2 and pref", s.cookies, len(s.domains), len(s.paths), len(s.names), s.largest.Name)
+	}
+}
+
+func TestFormatRelative(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "now"},
+		{59 * time.Second, "now"},
+		{-59 * time.Second, "now"},
+		{5 * time.Minute, "in 5m"},
+		{-5 * time.Minute, "5m ago"},
+		{90 * time.Minute, "in 1h"},
+		{23 * time.Hour, "in 23h"},
+		{3 * day, "in 3d"},
+		{-364 * day, "364d ago"},
+		{365 * day, "in 1y"},
+		{-2*365*day - day, "2y ago"},
+	}
+	for _, tt := range tests {
+		if got := formatRelative(tt.d); got != tt.want {
+			t.Errorf("formatRelative(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestOutputAsInflux(t *testing.T) {
+	data := buildFile(buildPage(
+		buildCookie(testCookie{name: `sid`, value: "1", domain: ".example.com", path: "/", flags: 5, created: 700000000}),
+		buildCookie(testCookie{name: `a"b\c`, value: "2", domain: "odd host,x=y", path: "/", flags: 1}),
+		buildCookie(testCookie{name: "nodomain", value: "3", path: "/"}),
+	))
+	cookies, err := parseCookies(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := outputAsInflux(&out, cookies); err != nil {
+		t.Fatal(err)
+	}
+	want := `cookies,domain=.example.com,flags=Secure;\ HttpOnly name="sid",size=77i 1678307200000000000
+cookies,domain=odd\ host\,x\=y,flags=Secure name="a\"b\\c",size=79i 978307200000000000
+cookies,flags=None name="nodomain",size=70i 978307200000000000
+`
+	if out.String() != want {
+		t.Errorf("got:\n%swant:\n%s", out.String(), want)
+	}
+}
+
+func TestOutputAsXLSX(t *testing.T) {
+	data := buildFile(buildPage(
+		buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/", flags: 5, expires: 800000000, created: 700000000}),
+		buildCookie(testCookie{name: "s&m", value: "<x>", domain: "example.com", path: "/", created: 700000000}),
+	))
+	cookies, err := parseCookies(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := outputAsXLSX(&out, cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("output isn't a zip file: %v", err)
+	}
+	parts := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+		// Excel refuses to open a workbook with any part that isn't well-formed XML
+		if err := xml.Unmarshal(parts[f.Name], new(interface{})); err != nil {
+			t.Errorf("%s isn't well-formed XML: %v", f.Name, err)
+		}
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if parts[name] == nil {
+			t.Errorf("missing part %s", name)
+		}
+	}
+
+	var sheet struct {
+		Pane struct {
+			State string `xml:"state,attr"`
+			Split string `xml:"ySplit,attr"`
+		} `xml:"sheetViews>sheetView>pane"`
+		Rows []struct {
+			Cells []struct {
+				Style string `xml:"s,attr"`
+				Text  string `xml:"is>t"`
+				Value string `xml:"v"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+		Filter struct {
+			Ref string `xml:"ref,attr"`
+		} `xml:"autoFilter"`
+	}
+	if err := xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &sheet); err != nil {
+		t.Fatal(err)
+	}
+	if sheet.Pane.State != "frozen" || sheet.Pane.Split != "1" {
+		t.Errorf("got pane state %q and split %q, want the top row frozen", sheet.Pane.State, sheet.Pane.Split)
+	}
+	if sheet.Filter.Ref != "A1:G3" {
+		t.Errorf("got auto filter over %q, want A1:G3", sheet.Filter.Ref)
+	}
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("got %d rows, want a header and 2 cookies", len(sheet.Rows))
+	}
+
+	var headers []string
+	for _, cell := range sheet.Rows[0].Cells {
+		headers = append(headers, cell.Text)
+	}
+	if got := strings.Join(headers, ","); got != "name,value,domain,path,expires,lastAccessed,flags" {
+		t.Errorf("got headers %s", got)
+	}
+	if got := sheet.Rows[2].Cells[0].Text + sheet.Rows[2].Cells[1].Text; got != "s&m<x>" {
+		t.Errorf("got name and value %q, want them unescaped as s&m<x>", got)
+	}
+	// 800000000 seconds after 2001-01-01 is 2026-05-09 06:13:20 UTC, which is day 46151 in Excel
+	expires := sheet.Rows[1].Cells[4]
+	if expires.Style != "1" || !strings.HasPrefix(expires.Value, "46151.") {
+		t.Errorf("got expires %q with style %q, want a date", expires.Value, expires.Style)
+	}
+	if session := sheet.Rows[2].Cells[4]; session.Text != "session" {
+		t.Errorf("got session cookie expires %q, want session", session.Text)
+	}
+}
+
+func TestShannonEntropy(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"", 0},
+		{"aaaa", 0},
+		{"ab", 1},
+		{"aabb", 1},
+		{"abcd", 2},
+		{"0123456789abcdef", 4},
+		{string(all), 8},
+		{"aaab", 0.8112781244591328},
+	}
+	for _, tt := range tests {
+		if got := shannonEntropy(tt.value); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("shannonEntropy(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	cookies := []cookie{{Value: "aaaa"}, {Value: "0123456789abcdef"}, {Value: "abcd"}}
+	if got := filterByEntropy(cookies, 2); len(got) != 2 || got[0].Value != "0123456789abcdef" || got[1].Value != "abcd" {
+		t.Errorf("filterByEntropy(2) kept %v, want the 2 values with at least 2 bits per byte", got)
+	}
+}
+
+// This function reads back a stream written by outputAsProtobuf, giving each message as a map from field number to the
+// field's value (a uint64 for varints, a string for length-delimited fields)
+func readProtobufStream(t *testing.T, data []byte) []map[int]interface{} {
+	t.Helper()
+	var messages []map[int]interface{}
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			t.Fatalf("bad length prefix in %x", data)
+		}
+		msg := data[n : n+int(size)]
+		data = data[n+int(size):]
+
+		fields := make(map[int]interface{})
+		for len(msg) > 0 {
+			tag, n := binary.Uvarint(msg)
+			msg = msg[n:]
+			value, n := binary.Uvarint(msg)
+			msg = msg[n:]
+			switch tag & 7 {
+			case 0:
+				fields[int(tag>>3)] = value
+			case 2:
+				fields[int(tag>>3)] = string(msg[:value])
+				msg = msg[value:]
+			default:
+				t.Fatalf("unexpected wire type %d", tag&7)
+			}
+		}
+		messages = append(messages, fields)
+	}
+	return messages
+}
+
+// A protoField is a field of the Cookie message in cookie.proto
+type protoField struct {
+	name, kind string
+}
+
+// This function reads the fields of the Cookie message from cookie.proto, keyed by their numbers
+func readCookieProto(t *testing.T) map[int]protoField {
+	t.Helper()
+	schema, err := os.ReadFile("cookie.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[int]protoField)
+	for _, match := range regexp.MustCompile(`(?m)^\s*(\w+) (\w+) = (\d+);`).FindAllStringSubmatch(string(schema), -1) {
+		number, _ := strconv.Atoi(match[3])
+		fields[number] = protoField{name: match[2], kind: match[1]}
+	}
+	return fields
+}
+
+func TestOutputAsProtobuf(t *testing.T) {
+	cookies, err := parseCookies(buildFile(buildPage(
+		buildCookie(testCookie{name: "sid", value: "abc", domain: ".example.com", path: "/", flags: 5, expires: 700000000, created: 600000000}),
+		buildCookie(testCookie{name: "\xfe", value: "\xff", domain: "example.com", path: "/"}),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodeInvalidUTF8(cookies)
+
+	var out bytes.Buffer
+	if err := outputAsProtobuf(&out, cookies); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each field written must be in cookie.proto, with a wire type that matches its type there
+	schema := readCookieProto(t)
+	if len(schema) != 12 {
+		t.Fatalf("cookie.proto has %d fields, want 12", len(schema))
+	}
+	var got []map[string]interface{}
+	for _, message := range readProtobufStream(t, out.Bytes()) {
+		named := make(map[string]interface{})
+		for number, value := range message {
+			field, ok := schema[number]
+			if !ok {
+				t.Fatalf("field %d isn't in cookie.proto", number)
+			}
+			if _, isString := value.(string); isString != (field.kind == "string") {
+				t.Errorf("field %d (%s) is a %s in cookie.proto, but was written as %T", number, field.name, field.kind, value)
+			}
+			named[field.name] = value
+		}
+		got = append(got, named)
+	}
+
+	want := []map[string]interface{}{
+		{"name": "sid", "value": "abc", "domain": ".example.com", "path": "/", "flags": "Secure; HttpOnly", "expires": uint64(978307200 + 700000000), "last_accessed": uint64(978307200 + 600000000), "size": cookies[0].Size},
+		{"name": "/g==", "value": "/w==", "domain": "example.com", "path": "/", "flags": "None", "last_accessed": uint64(978307200), "size": cookies[1].Size, "session": uint64(1), "value_encoding": "base64", "name_encoding": "base64"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCamelToSnake(t *testing.T) {
+	for key, want := range map[string]string{
+		"name":               "name",
+		"lastAccessed":       "last_accessed",
+		"creationRaw":        "creation_raw",
+		"expiresUnder30Days": "expires_under_30_days",
+		"expires30To90Days":  "expires_30_to_90_days",
+		"expiresOver90Days":  "expires_over_90_days",
+	} {
+		if got := camelToSnake(key); got != want {
+			t.Errorf("camelToSnake(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestRetentionJSON(t *testing.T) {
+	defer func(old string) { *jsonKeys = old }(*jsonKeys)
+	for _, tt := range []struct {
+		keys string
+		want string
+	}{
+		{"camel", `{"session":1,"expired":0,"expiresUnder30Days":0,"expires30To90Days":0,"expiresOver90Days":0,"total":1}`},
+		{"snake", `{"session":1,"expired":0,"expires_under_30_days":0,"expires_30_to_90_days":0,"expires_over_90_days":0,"total":1}`},
+	} {
+		*jsonKeys = tt.keys
+		var out bytes.Buffer
+		if err := outputAsRetentionJSON(&out, []cookie{{Name: "sid", Session: true}}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(out.String()) != tt.want {
+			t.Errorf("with -json-keys %s got %s, want %s", tt.keys, out.String(), tt.want)
+		}
+	}
+}
+
+func TestHiddenFlags(t *testing.T) {
+	var help bytes.Buffer
+	flag.CommandLine.SetOutput(&help)
+	defer flag.CommandLine.SetOutput(nil)
+	printHelp()
+
+	// Each flag's line in the help starts with two spaces and its name
+	shown := make(map[string]bool)
+	for _, line := range strings.Split(help.String(), "\n") {
+		if strings.HasPrefix(line, "  -") {
+			shown[strings.Fields(line)[0][1:]] = true
+		}
+	}
+	if !shown["i"] || !shown["d"] {
+		t.Errorf("-h doesn't show -i and -d:\n%s", help.String())
+	}
+	for name := range hiddenFlags {
+		if flag.Lookup(name) == nil {
+			t.Errorf("hidden flag -%s doesn't exist", name)
+		}
+		if shown[name] {
+			t.Errorf("-h shows the hidden flag -%s", name)
+		}
+	}
+
+	// -dump-flags lists exactly the flags -h shows
+	var dumped bytes.Buffer
+	if err := printFlags(&dumped); err != nil {
+		t.Fatal(err)
+	}
+	var flags []flagInfo
+	if err := json.Unmarshal(dumped.Bytes(), &flags); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range flags {
+		if !shown[f.Name] {
+			t.Errorf("-dump-flags lists -%s, which -h doesn't show", f.Name)
+		}
+	}
+	if len(flags) != len(shown) {
+		t.Errorf("-dump-flags lists %d flags, but -h shows %d", len(flags), len(shown))
+	}
+}
+
+func TestRawTime(t *testing.T) {
+	defer func(old bool) { *rawTime = old }(*rawTime)
+	*rawTime = true
+	cookies, err := parseCookies(buildFile(buildPage(
+		buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/", expires: 700000000.25, created: 600000000.5}),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := outputAsJSON(&out, cookies); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("output isn't valid JSON: %v\n%s", err, out.String())
+	}
+	if got[0]["expiresRaw"] != 700000000.25 || got[0]["creationRaw"] != 600000000.5 {
+		t.Errorf("got expiresRaw %v and creationRaw %v, want 700000000.25 and 600000000.5", got[0]["expiresRaw"], got[0]["creationRaw"])
+	}
+
+	out.Reset()
+	if err := outputAsCSV(&out, cookies); err != nil {
+		t.Fatal(err)
+	}
+	if header := strings.SplitN(out.String(), "\n", 2)[0]; !strings.Contains(header, "expiresRaw") || !strings.Contains(header, "creationRaw") {
+		t.Errorf("got CSV header %q, want one with expiresRaw and creationRaw", header)
+	}
+}
+
+func TestSplitDatetime(t *testing.T) {
+	defer func(old bool, location *time.Location) { *splitDatetime, splitLocation = old, location }(*splitDatetime, splitLocation)
+	*splitDatetime = true
+	cookies, err := parseCookies(buildFile(buildPage(
+		buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/", expires: 700000000, created: 600000000}),
+		buildCookie(testCookie{name: "s", value: "x", domain: "example.com", path: "/", created: 600000000}),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tt := range []struct {
+		location *time.Location
+		want     string
+	}{
+		{time.UTC, "name,value,domain,path,expires_date,expires_time,creation_date,creation_time,flags\n" +
+			"sid,abc,example.com,/,2023-03-08,20:26:40,2020-01-06,10:40:00,None\n" +
+			"s,x,example.com,/,session,,2020-01-06,10:40:00,None\n"},
+		{tokyo, "name,value,domain,path,expires_date,expires_time,creation_date,creation_time,flags\n" +
+			"sid,abc,example.com,/,2023-03-09,05:26:40,2020-01-06,19:40:00,None\n" +
+			"s,x,example.com,/,session,,2020-01-06,19:40:00,None\n"},
+	} {
+		splitLocation = tt.location
+		var out bytes.Buffer
+		if err := outputAsCSV(&out, cookies); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("in %s got:\n%swant:\n%s", tt.location, out.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,1069 @@
+// Package binarycookies decodes the binary cookies files (Cookies.binarycookies) that Safari and iOS/iPadOS apps keep
+// their cookies in. It is the parser behind binary-cookie-extractor, for Go code that wants the cookies without running
+// the command.
+//
+// A file starts with a header: the magic number "cook", the number of pages, and the size of each page (all big-endian).
+// The pages follow, then an 8 byte footer. Each page holds a number of cookie records, and each record is a fixed 56 byte
+// header (its size, flags, the offsets of its strings, and its expiry and creation times) followed by the domain, name,
+// path, and value as null terminated strings.
+//
+// Files are read a page at a time, so decoding a large file with ForEach only ever holds one page of it in memory.
+package binarycookies
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// A Decoder decodes binary cookies files. The zero Decoder decodes files the way Safari writes them, and is what ForEach,
+// Parse, ParseWithInfo, and ParseJar use. The fields are for variant files, and for following along when a file decodes
+// wrongly
+type Decoder struct {
+	// The 4 byte signature files must start with. Empty means "cook"
+	Magic string
+	// Whether the page sizes in the header include each page's 4 byte header: "yes", "no", or "auto" (the same as empty),
+	// which works it out from where the second page starts
+	PageSizeIncludesHeader string
+	// Read the timestamps as seconds since 1970, as some third-party cookie jars store them, rather than since 2001 (the
+	// Core Data epoch)
+	UnixEpoch bool
+	// Decode values that look like UTF-16 as UTF-16, rather than cutting them off at the first null byte
+	DetectUTF16 bool
+
+	// Called, if set, with each warning as it is found
+	Warn func(Warning)
+	// Called, if set, with a description of each step of decoding
+	Debugf func(format string, args ...interface{})
+	// Called, if set, with the state of the decoder at each step (the header, each page, and each cookie) as named fields
+	Event func(event string, fields map[string]interface{})
+}
+
+// The Decoder used by the package level functions
+var defaultDecoder Decoder
+
+// A Cookie is a cookie decoded from a binary cookies file
+type Cookie struct {
+	// The size the cookie's record declares, in bytes
+	Size   uint64
+	Name   string
+	Value  string
+	Domain string
+	Path   string
+	// The flag bits as stored: FlagSecure, FlagHTTPOnly, both, or (rarely) others that aren't known
+	Flags   uint32
+	Expires time.Time
+	Created time.Time
+	// The timestamps as stored, before they are rounded to whole seconds: seconds since 2001-01-01, or since 1970 when the
+	// Decoder has UnixEpoch set
+	ExpiresRaw float64
+	CreatedRaw float64
+	// Session cookies are stored with an expiry at (or within a day of) the Core Data or UNIX epoch
+	Session bool
+	// Some variants mark a deleted cookie by pointing its value offset at the very end of its record. Deleted cookies are
+	// kept, as the deletion can be evidence
+	Deleted bool
+	// Problems with the cookie that didn't stop it being decoded, like a string offset outside the record
+	Warnings []string
+	// The cookie's record, as carved from its page
+	Raw []byte
+	// Where the cookie was found: its page and its position in the page (both counting from 1), and the byte in the file
+	// its record starts at. ParseCookie has no page, so it leaves Page and Offset 0
+	Page   int
+	Number int
+	Offset int
+}
+
+// The flag bits a cookie can have
+const (
+	FlagSecure   = 0x1
+	FlagHTTPOnly = 0x4
+)
+
+// This method describes the cookie's flags: None, Secure, HttpOnly, or "Secure; HttpOnly", or Unknown for any other
+// combination of bits
+func (c Cookie) FlagText() string {
+	switch c.Flags {
+	case 0:
+		return "None"
+	case FlagSecure:
+		return "Secure"
+	case FlagHTTPOnly:
+		return "HttpOnly"
+	case FlagSecure | FlagHTTPOnly:
+		return "Secure; HttpOnly"
+	}
+	return "Unknown"
+}
+
+// A Warning describes something wrong with a file that didn't stop it being decoded, like a cookie that had to be
+// skipped or a page that was cut off
+type Warning struct {
+	Msg string
+	// Set for problems the decoder works around by itself (e.g. a cookie's declared size not matching the bytes carved
+	// for it), which are usually only worth showing when looking into a file that decodes wrongly
+	Minor bool
+	// The error behind the warning, if there was one. For a skipped cookie it wraps the *ParseError saying why, which
+	// errors.As can get at
+	Err error
+}
+
+// A Header is the start of a binary cookies file, giving the number of pages and the size declared for each
+type Header struct {
+	NumPages  uint64
+	PageSizes []uint64
+	// The bytes the header takes up: the magic number, the page count, and a size for each page
+	Size uint64
+}
+
+// A FileInfo describes the layout of a binary cookies file, as returned by ParseWithInfo
+type FileInfo struct {
+	FileSize   int        `json:"fileSize"`
+	NumPages   uint64     `json:"numPages"`
+	HeaderSize uint64     `json:"headerSize"`
+	NumCookies int        `json:"numCookies"`
+	Pages      []PageInfo `json:"pages"`
+	// Everything after the last page declared in the header (normally an 8 byte footer), in hex
+	Footer string `json:"footer"`
+	// Everything found wrong with the file that didn't stop it being decoded, in the order it was found
+	Warnings []Warning `json:"-"`
+}
+
+// A PageInfo gives the byte range a page occupies in the file. Start and End (which is exclusive) are worked out from the
+// header size and the page sizes declared in the header, while CarvedSize is how many bytes were actually read for the
+// page, so the two can be compared when a page looks wrong. Pages recovered by scanning (when the header declares no
+// pages) have no declared size, so their range is where they were found
+type PageInfo struct {
+	Number      int    `json:"number"`
+	Start       uint64 `json:"start"`
+	End         uint64 `json:"end"`
+	Size        uint64 `json:"size"`
+	CarvedSize  int    `json:"carvedSize"`
+	CookieCount uint64 `json:"cookieCount"`
+	// The page's first 4 bytes (normally 00000100), and every byte before its first cookie, in hex
+	PageHeader   string `json:"pageHeader"`
+	HeaderRegion string `json:"headerRegion"`
+	// Every cookie found in the page, so unusually dense or nearly empty pages stand out
+	Cookies []PageCookieInfo `json:"cookies"`
+}
+
+// A PageCookieInfo gives where a cookie starts in its page (its offset from the page's offset list) and the size it
+// declares. Cookies that were skipped as corrupt are included, as they still take up space in the page
+type PageCookieInfo struct {
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+}
+
+// A ParseError is returned when a binary cookies file (or part of one) can't be parsed, saying where the problem was so
+// that Go code can tell, for example, a bad header from one bad cookie without matching on the message. Page and Cookie
+// count from 1, and are 0 when the problem isn't in a particular page or cookie. Offset is the byte in the file at which
+// the problem was found, or -1 when it isn't at a particular byte (e.g. an invalid option saying where to start)
+type ParseError struct {
+	Offset int
+	Page   int
+	Cookie int
+	Msg    string
+}
+
+// This method gives the message, followed by where in the file the problem was found
+func (e *ParseError) Error() string {
+	if e.Offset < 0 {
+		return e.Msg
+	}
+	where := fmt.Sprintf("at byte %d", e.Offset)
+	if e.Cookie > 0 && e.Page > 0 {
+		where = fmt.Sprintf("cookie %d in page %d, %s", e.Cookie, e.Page, where)
+	} else if e.Page > 0 {
+		where = fmt.Sprintf("page %d, %s", e.Page, where)
+	}
+	return fmt.Sprintf("%s (%s)", e.Msg, where)
+}
+
+// This function decodes the binary cookies file read from r and calls fn with each cookie as it is decoded, in file order.
+// It stops at the first error returned by fn and returns it. The file is read a page at a time and the full slice of
+// cookies is never built, so this is for callers that process cookies one at a time (e.g. streaming them into a database)
+func ForEach(r io.Reader, fn func(Cookie) error) error {
+	return defaultDecoder.ForEach(r, fn)
+}
+
+// This method is ForEach, decoding with the options set on d
+func (d *Decoder) ForEach(r io.Reader, fn func(Cookie) error) error {
+	p := &parser{Decoder: d}
+	return p.decode(r, func(_ *page, cookies []Cookie) error {
+		for _, c := range cookies {
+			if err := fn(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// This function decodes the binary cookies file read from r and returns its cookies. An invalid file is reported by
+// returning an error, while problems that only affect some of the cookies are warnings (see Decoder.Warn)
+//
+// The cookies are always in file order: by page, then by position within the page. Output that isn't sorted (and tests
+// comparing against known good output) depends on this, so any change to how pages are decoded (e.g. decoding them
+// concurrently) must put the cookies back in this order
+func Parse(r io.Reader) ([]Cookie, error) {
+	return defaultDecoder.Parse(r)
+}
+
+// This method is Parse, decoding with the options set on d
+func (d *Decoder) Parse(r io.Reader) ([]Cookie, error) {
+	var cookies []Cookie
+	err := d.ForEach(r, func(c Cookie) error {
+		cookies = append(cookies, c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// This function decodes the binary cookies file read from r like Parse, but also returns the layout of the file (its
+// pages, their sizes, and the footer) and the warnings found in it, for Go code that needs page-level information as well
+// as the cookies
+func ParseWithInfo(r io.Reader) (FileInfo, []Cookie, error) {
+	return defaultDecoder.ParseWithInfo(r)
+}
+
+// This method is ParseWithInfo, decoding with the options set on d
+func (d *Decoder) ParseWithInfo(r io.Reader) (FileInfo, []Cookie, error) {
+	p := &parser{Decoder: d}
+	info := FileInfo{Pages: []PageInfo{}}
+	var cookies []Cookie
+	err := p.decode(r, func(pg *page, pageCookies []Cookie) error {
+		info.Pages = append(info.Pages, p.pageInfo(pg))
+		cookies = append(cookies, pageCookies...)
+		return nil
+	})
+	if err != nil {
+		return FileInfo{}, nil, err
+	}
+
+	info.FileSize, info.NumPages, info.HeaderSize, info.NumCookies = int(p.pos), p.header.NumPages, p.header.Size, len(cookies)
+	if p.header.NumPages > 0 {
+		info.Footer = hex.EncodeToString(p.footer)
+	}
+	info.Warnings = p.warnings
+	return info, cookies, nil
+}
+
+// This method describes where pg was found in the file and the cookies in it
+func (p *parser) pageInfo(pg *page) PageInfo {
+	entry := PageInfo{Number: pg.number, Start: pg.offset, CarvedSize: len(pg.rawBytes), CookieCount: pg.numCookiesInPage, HeaderRegion: hex.EncodeToString(pg.headerRegion)}
+	if len(pg.rawBytes) >= 4 {
+		entry.PageHeader = hex.EncodeToString(pg.rawBytes[:4])
+	}
+	entry.Cookies = []PageCookieInfo{}
+	for _, offset := range pg.cookieOffsets {
+		cookieInfo := PageCookieInfo{Offset: offset}
+		if offset+4 <= uint64(len(pg.rawBytes)) {
+			cookieInfo.Size = convertHexToUint(reverseByteSlice(pg.rawBytes[offset : offset+4]))
+		}
+		entry.Cookies = append(entry.Cookies, cookieInfo)
+	}
+	if pg.number <= len(p.header.PageSizes) {
+		entry.Size = p.header.PageSizes[pg.number-1]
+		entry.End = entry.Start + entry.Size + p.adjustment
+	} else {
+		entry.Size = uint64(len(pg.rawBytes))
+		entry.End = entry.Start + entry.Size
+	}
+	return entry
+}
+
+// This function decodes one cookie's raw bytes (the cookie record from its size field onwards, as found in a page) that
+// were carved some other way, e.g. by hand from a memory dump or a damaged file. The bytes may run on past the cookie's
+// declared size, but not fall short of it. A record that can't be decoded is reported with a *ParseError (whose Offset
+// counts from the start of raw), while a string offset outside the record leaves that field empty and is listed in the
+// cookie's Warnings
+func ParseCookie(raw []byte) (Cookie, error) {
+	return defaultDecoder.ParseCookie(raw)
+}
+
+// This method is ParseCookie, decoding with the options set on d
+func (d *Decoder) ParseCookie(raw []byte) (Cookie, error) {
+	return (&parser{Decoder: d}).decodeCookie(raw, true, 0, 1)
+}
+
+// A Jar holds everything decoded from a binary cookies file: the layout of its pages, and its cookies in file order
+type Jar struct {
+	Info    FileInfo
+	Cookies []Cookie
+}
+
+// This function decodes the binary cookies file read from r into a Jar, for Go code that wants to query the cookies
+// rather than iterate over them. Like Parse, an invalid file is reported by returning an error
+func ParseJar(r io.Reader) (*Jar, error) {
+	return defaultDecoder.ParseJar(r)
+}
+
+// This method is ParseJar, decoding with the options set on d
+func (d *Decoder) ParseJar(r io.Reader) (*Jar, error) {
+	info, cookies, err := d.ParseWithInfo(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Jar{Info: info, Cookies: cookies}, nil
+}
+
+// This method returns the cookies set for the given domain. Domains are matched ignoring case and a single leading dot,
+// so example.com matches cookies for both .Example.com and example.com
+func (j *Jar) ByDomain(domain string) []Cookie {
+	want := strings.TrimPrefix(strings.ToLower(domain), ".")
+	var result []Cookie
+	for i := 0; i < len(j.Cookies); i++ {
+		if strings.TrimPrefix(strings.ToLower(j.Cookies[i].Domain), ".") == want {
+			result = append(result, j.Cookies[i])
+		}
+	}
+	return result
+}
+
+// This method returns the cookies that haven't expired yet. Session cookies have no expiry date, so they are always
+// counted as active
+func (j *Jar) Active() []Cookie {
+	now := time.Now()
+	var result []Cookie
+	for i := 0; i < len(j.Cookies); i++ {
+		if j.Cookies[i].Session || j.Cookies[i].Expires.After(now) {
+			result = append(result, j.Cookies[i])
+		}
+	}
+	return result
+}
+
+// This method returns the name of every cookie in the jar, sorted alphabetically and with duplicates removed
+func (j *Jar) Names() []string {
+	seen := make(map[string]bool)
+	var result []string
+	for i := 0; i < len(j.Cookies); i++ {
+		if !seen[j.Cookies[i].Name] {
+			seen[j.Cookies[i].Name] = true
+			result = append(result, j.Cookies[i].Name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// This method reads the header of a binary cookies file from r, without reading any further. An error is returned if
+// the magic number is wrong, or if the file is too short to hold the page count or a size for each of the pages counted,
+// which is how a header with a wider (e.g. 8 byte) page count, or a corrupt one, shows up
+func (d *Decoder) ReadHeader(r io.Reader) (Header, error) {
+	return (&parser{Decoder: d}).readHeader(r)
+}
+
+// This method returns how many bytes the header h and the pages it declares take up in data, the contents of the file h
+// was read from (which is looked at to tell whether the page sizes include the page headers). It isn't capped to the
+// length of data, so a result longer than data means the file is truncated
+func (d *Decoder) DeclaredLength(h Header, data []byte) uint64 {
+	var next []byte
+	if len(h.PageSizes) > 0 {
+		if end := h.Size + h.PageSizes[0]; end < uint64(len(data)) {
+			next = data[end:]
+		}
+	}
+	adjustment := (&parser{Decoder: d}).pageSizeAdjustment(h.NumPages, next)
+	length := h.Size
+	for _, size := range h.PageSizes {
+		length += size + adjustment
+	}
+	return length
+}
+
+// A parser holds the state of decoding one file, so that nothing is shared between files or carried over from one to the
+// next
+type parser struct {
+	*Decoder
+	header Header
+	// What to add to each declared page size to get the bytes the page takes up: 4 in variants whose page sizes leave
+	// out the page's 00000100 header, and 0 otherwise
+	adjustment uint64
+	// How far into the file has been read, and what came after the last declared page
+	pos    uint64
+	footer []byte
+
+	warnings []Warning
+}
+
+type page struct {
+	number           int    // position of the page in the file, counting from 1
+	offset           uint64 // position of the page's first byte in the file
+	rawBytes         []byte
+	numCookiesInPage uint64
+	cookieOffsets    []uint64
+	headerRegion     []byte   // everything in the page before its first cookie
+	records          [][]byte // the raw bytes of each cookie, carved using cookieOffsets
+}
+
+// This method records a warning about something odd in the file that doesn't stop it being decoded, and passes it to
+// the Warn callback
+func (p *parser) warn(format string, args ...interface{}) {
+	p.addWarning(Warning{Msg: fmt.Sprintf(format, args...)})
+}
+
+// This method records a warning like warn, but marks it as minor. It is for problems the decoder works around by itself
+func (p *parser) debugWarn(format string, args ...interface{}) {
+	p.addWarning(Warning{Msg: fmt.Sprintf(format, args...), Minor: true})
+}
+
+func (p *parser) addWarning(w Warning) {
+	p.warnings = append(p.warnings, w)
+	if p.Warn != nil {
+		p.Warn(w)
+	}
+}
+
+// This method passes a debug message to the Debugf callback, if there is one
+func (p *parser) debugf(format string, args ...interface{}) {
+	if p.Debugf != nil {
+		p.Debugf(format, args...)
+	}
+}
+
+// This method returns the magic number files must start with
+func (d *Decoder) magic() string {
+	if d.Magic == "" {
+		return "cook"
+	}
+	return d.Magic
+}
+
+// This method decodes the binary cookies file read from r, calling fn with each page and the cookies decoded from it in
+// file order. It is the one place files are decoded, behind ForEach, Parse, ParseWithInfo, and ParseJar. Only the page
+// being decoded is held in memory, apart from the last page, which runs to the end of the file and so takes in the footer
+func (p *parser) decode(r io.Reader, fn func(pg *page, cookies []Cookie) error) error {
+	br := bufio.NewReader(r)
+	h, err := p.readHeader(br)
+	if err != nil {
+		return err
+	}
+	p.header, p.pos = h, h.Size
+
+	// A page count of 0 with data after the header means the count is wrong, rather than the file being empty. Rather than
+	// silently returning nothing, try to find the pages by scanning for their headers
+	if h.NumPages == 0 {
+		rest, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		p.pos += uint64(len(rest))
+		if len(rest) == 0 {
+			return nil
+		}
+		recovered := p.recoverPages(rest, h.Size)
+		p.warn("The header says there are 0 pages, but there are %d bytes after it. Recovered %d pages by scanning for page headers", len(rest), len(recovered))
+		for _, pg := range recovered {
+			if err := fn(pg, p.decodePage(pg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if p.PageSizeIncludesHeader == "no" {
+		p.adjustment = 4
+	}
+	for i, size := range h.PageSizes {
+		// A file that was cut short can be missing its last pages entirely, or have them cut off part way through. The
+		// pages that are there are still decoded, with an incomplete last page running to the end of the file
+		if _, err := br.Peek(1); err == io.EOF {
+			p.warn("The file ends before page %d (of %d) starts, so it is truncated. Only the first %d pages were decoded", i+1, len(h.PageSizes), i)
+			break
+		} else if err != nil {
+			return err
+		}
+
+		pg := &page{number: i + 1, offset: p.pos}
+		pageLength := size + p.adjustment
+		if i == len(h.PageSizes)-1 {
+			// You're at the last page, so just read to the end of the file
+			if pg.rawBytes, err = io.ReadAll(br); err != nil {
+				return err
+			}
+			if uint64(len(pg.rawBytes)) > pageLength {
+				p.footer = pg.rawBytes[pageLength:]
+			}
+		} else {
+			// There's another page after the current one, so its size says where to stop
+			if pg.rawBytes, err = io.ReadAll(io.LimitReader(br, int64(pageLength))); err != nil {
+				return err
+			}
+			if uint64(len(pg.rawBytes)) < pageLength {
+				p.warn("Page %d (of %d) runs past the end of the file, so it is truncated", i+1, len(h.PageSizes))
+				if i == 0 {
+					// There's no second page to check against, which pageSizeAdjustment reports
+					p.adjustment = p.pageSizeAdjustment(h.NumPages, nil)
+				}
+			} else if i == 0 && p.PageSizeIncludesHeader != "yes" && p.PageSizeIncludesHeader != "no" {
+				next, _ := br.Peek(8)
+				p.adjustment = p.pageSizeAdjustment(h.NumPages, next)
+				extra := make([]byte, p.adjustment)
+				if _, err := io.ReadFull(br, extra); err != nil {
+					return err
+				}
+				pg.rawBytes = append(pg.rawBytes, extra...)
+			}
+		}
+		p.pos += uint64(len(pg.rawBytes))
+		p.debugf("Value of rawBytes in page %d: %v", i+1, pg.rawBytes)
+
+		if err := fn(pg, p.decodePage(pg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The header of a binary cookies file is the magic number, then the number of pages as a 4 byte big-endian integer, then
+// the size of each page as another 4 byte big-endian integer. No known variant uses wider fields, and one that did would
+// be misread, so readHeader checks that the count it reads makes sense for the file
+const (
+	pageCountOffset   = 4
+	pageCountSize     = 4
+	pageSizeFieldSize = 4
+)
+
+// This method reads the header of a binary cookies file from r (see ReadHeader)
+func (p *parser) readHeader(r io.Reader) (Header, error) {
+	var h Header
+	field := make([]byte, 4)
+	n, err := readField(r, field)
+	if err != nil {
+		return h, err
+	}
+	if n < len(field) || string(field) != p.magic() {
+		return h, &ParseError{Msg: "file is not a valid iOS/Safari binary cookies file"}
+	}
+
+	if n, err = readField(r, field); err != nil {
+		return h, err
+	}
+	if n < pageCountSize {
+		size := pageCountOffset + n
+		return h, &ParseError{Offset: size, Msg: fmt.Sprintf("header is truncated: the file is %d bytes, too short for the page count", size)}
+	}
+	h.NumPages = convertHexToUint(field)
+	h.Size = h.NumPages*pageSizeFieldSize + pageCountOffset + pageCountSize
+	p.debugf("Number of pages: %d", h.NumPages)
+
+	for i := uint64(0); i < h.NumPages; i++ {
+		if n, err = readField(r, field); err != nil {
+			return Header{}, err
+		}
+		if n < pageSizeFieldSize {
+			size := pageCountOffset + pageCountSize + i*pageSizeFieldSize + uint64(n)
+			return Header{}, &ParseError{Offset: pageCountOffset, Msg: fmt.Sprintf("header is truncated: %d pages need a %d byte header, but the file is %d bytes (the page count is read as a %d byte field)", h.NumPages, h.Size, size, pageCountSize)}
+		}
+		h.PageSizes = append(h.PageSizes, convertHexToUint(field))
+		p.debugf("Size of page %d: %d bytes", i+1, h.PageSizes[i])
+	}
+
+	p.debugf("Size of header: %d bytes", h.Size)
+	if p.Event != nil {
+		p.Event("header", map[string]interface{}{"numPages": h.NumPages, "headerSize": h.Size, "pageSizes": h.PageSizes})
+	}
+	return h, nil
+}
+
+// This function fills field from r, returning how many bytes it got. Running out of file isn't an error here, as the
+// caller reports it with where it happened
+func readField(r io.Reader, field []byte) (int, error) {
+	n, err := io.ReadFull(r, field)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+// This method works out what to add to each declared page size to find where the next page starts. Most files' page
+// sizes include each page's 4 byte 00000100 header, but some variants leave it out, putting every page after the first 4
+// bytes later than its size says. PageSizeIncludesHeader can say which, but by default both are tried on next (the bytes
+// just after the first page, going by its declared size): whichever has the second page start with 00000100 is used.
+// When neither does (or there's only one page, so nothing to check), the page sizes are taken to include the header
+func (p *parser) pageSizeAdjustment(numPages uint64, next []byte) uint64 {
+	switch p.PageSizeIncludesHeader {
+	case "yes":
+		return 0
+	case "no":
+		return 4
+	}
+	if numPages < 2 {
+		return 0
+	}
+	if bytes.HasPrefix(next, pageHeader) {
+		return 0
+	}
+	if len(next) >= 8 && bytes.Equal(next[4:8], pageHeader) {
+		p.debugf("The page sizes leave out the 4 byte page header, so each page is 4 bytes longer than declared")
+		return 4
+	}
+	p.debugf("Couldn't tell whether the page sizes include the page header (the second page doesn't start where either says), assuming they do")
+	return 0
+}
+
+// Every page starts with these bytes
+var pageHeader = []byte{0x00, 0x00, 0x01, 0x00}
+
+// This method scans data (everything after a file header that declares no pages, which starts base bytes into the file)
+// for page headers, for use when the page count in the file header can't be trusted. As the page header bytes can also
+// appear inside cookies, a match is only taken as a page if the cookie count and offsets after it make sense and are
+// followed by the 00000000 terminator. Each page is taken to end where its last cookie's declared size says it does, and
+// the search for the next page carries on from there
+func (p *parser) recoverPages(data []byte, base uint64) []*page {
+	var result []*page
+	pos := 0
+	for pos < len(data) {
+		idx := bytes.Index(data[pos:], pageHeader)
+		if idx < 0 {
+			break
+		}
+		start := pos + idx
+		end, ok := recoveredPageEnd(data[start:])
+		if !ok {
+			pos = start + 1
+			continue
+		}
+		p.debugf("Recovered page %d at offset %d (%d bytes)", len(result)+1, base+uint64(start), end)
+		result = append(result, &page{number: len(result) + 1, offset: base + uint64(start), rawBytes: data[start : start+end]})
+		pos = start + end
+	}
+	return result
+}
+
+// This function checks whether data (which starts with a page header) looks like a real page, and if so returns its
+// length. The cookie count must be non-zero, the offsets must be in order and inside data, and the terminator must follow
+// them
+func recoveredPageEnd(data []byte) (int, bool) {
+	if len(data) < 12 {
+		return 0, false
+	}
+	numCookies := int(convertHexToUint(reverseByteSlice(data[4:8])))
+	offsetsEnd := 8 + numCookies*4
+	if numCookies == 0 || offsetsEnd+4 > len(data) || convertHexToUint(data[offsetsEnd:offsetsEnd+4]) != 0 {
+		return 0, false
+	}
+
+	previous := offsetsEnd + 4
+	for i := 0; i < numCookies; i++ {
+		offset := int(convertHexToUint(reverseByteSlice(data[8+i*4 : 12+i*4])))
+		if offset < previous || offset+4 > len(data) {
+			return 0, false
+		}
+		previous = offset
+	}
+
+	// The page ends after the last cookie, going by its declared size
+	end := previous + int(convertHexToUint(reverseByteSlice(data[previous:previous+4])))
+	if end <= previous || end > len(data) {
+		end = len(data)
+	}
+	return end, true
+}
+
+// This method carves the cookies out of pg, then decodes them. The cookies are returned in offset order, which is the
+// order they are in the file
+func (p *parser) decodePage(pg *page) []Cookie {
+	p.extractCookies(pg)
+
+	var cookies []Cookie
+	for j := 0; j < len(pg.records); j++ {
+		// A cookie that can't be decoded (e.g. it was cut off at the end of a recovered file) is skipped with a warning
+		isLast := j == len(pg.records)-1
+		aCookie, err := p.decodeCookie(pg.records[j], isLast, pg.number, j+1)
+		offset := int(pg.offset + pg.cookieOffsets[j])
+		if err != nil {
+			// decodeCookie only knows where in the cookie the problem was, so the offset is moved to be in the file
+			var parseErr *ParseError
+			msg := err.Error()
+			if errors.As(err, &parseErr) {
+				parseErr.Offset += offset
+				msg = fmt.Sprintf("%s (at byte %d)", parseErr.Msg, parseErr.Offset)
+			}
+			p.addWarning(Warning{
+				Msg: fmt.Sprintf("Cookie %d in page %d was skipped: %s", j+1, pg.number, msg),
+				Err: fmt.Errorf("cookie %d in page %d was skipped: %w", j+1, pg.number, err),
+			})
+			continue
+		}
+		aCookie.Offset = offset
+		cookies = append(cookies, aCookie)
+	}
+	return cookies
+}
+
+// This method extracts the raw cookies from a page, using the offsets at the start of it. No cookie decoding is done
+// here, this just gets the raw cookie bytes out for decodeCookie
+//
+// Each page is laid out as follows (multi-byte integers in a page are little-endian):
+//
+//	| Offset | Size  | Field                                                          |
+//	|--------|-------|----------------------------------------------------------------|
+//	| 0      | 4     | Page header, always 00 00 01 00                                |
+//	| 4      | 4     | Number of cookies in the page (N)                              |
+//	| 8      | 4 * N | Offset of each cookie, from the start of the page              |
+//	| 8+4N   | 4     | End of the offsets, always 00 00 00 00                         |
+//	| 12+4N  | ...   | The cookies themselves, each starting at its offset from above |
+func (p *parser) extractCookies(pg *page) {
+	// A page cut off before the end of its cookie count and first offset has no cookies that can be found
+	if len(pg.rawBytes) < 12 {
+		p.warn("Page %d is incomplete (%d bytes), so its cookies were skipped", pg.number, len(pg.rawBytes))
+		return
+	}
+
+	// First, get the number of cookies in the page
+	pg.numCookiesInPage = convertHexToUint(reverseByteSlice(pg.rawBytes[4:8]))
+	p.debugf("Number of cookies in page (%d): %d", pg.number, pg.numCookiesInPage)
+
+	// Each cookie needs a 4 byte offset after the 8 bytes before them, so a count higher than the page has room for
+	// can only come from a corrupt (or malicious) file. None of the page's offsets can be trusted then
+	if maxCookies := uint64(len(pg.rawBytes)-8) / 4; pg.numCookiesInPage > maxCookies {
+		p.warn("Page %d declares %d cookies, but its %d bytes only have room for %d, so its cookies were skipped", pg.number, pg.numCookiesInPage, len(pg.rawBytes), maxCookies)
+		return
+	}
+
+	// Next, get the offsets for the cookies (loop numCookiesInPage times). The count can't be trusted blindly, so this
+	// stops early at the first offset that can't be right: one past the end of the page, a zero (which is really the
+	// terminator, when the count is too high), or one that goes backwards
+	startOffset, endOffset := 8, 12
+	ranIntoCookie := false
+	for j := 0; j < int(pg.numCookiesInPage); j++ {
+		if endOffset > len(pg.rawBytes) {
+			p.debugWarn("Page %d: declares %d cookies, but the offsets run past the end of the page after %d", pg.number, pg.numCookiesInPage, j)
+			break
+		}
+		// The offsets all come before the first cookie, so with a count that is too high (and no terminator to stop
+		// at), reading on would take the first cookie's bytes as offsets
+		if len(pg.cookieOffsets) > 0 && uint64(endOffset) > pg.cookieOffsets[0] {
+			p.warn("Page %d: declares %d cookies, but its offsets run into the first cookie (at byte %d) after %d, so the rest were ignored", pg.number, pg.numCookiesInPage, pg.cookieOffsets[0], len(pg.cookieOffsets))
+			ranIntoCookie = true
+			break
+		}
+		cookieLen := convertHexToUint(reverseByteSlice(pg.rawBytes[startOffset:endOffset]))
+		// A zero offset followed by good ones isn't the terminator, but a corrupt offset. Carving from it would take
+		// the page header as a cookie, so it is skipped and the offsets after it are still used
+		if cookieLen == 0 && laterOffsetIsValid(pg, j, endOffset) {
+			p.warn("Page %d: the offset of cookie %d is 0, so it was skipped", pg.number, j+1)
+			startOffset += 4
+			endOffset += 4
+			continue
+		}
+		previous := len(pg.cookieOffsets) - 1
+		if cookieLen == 0 || cookieLen >= uint64(len(pg.rawBytes)) || (previous >= 0 && cookieLen < pg.cookieOffsets[previous]) {
+			p.debugWarn("Page %d: declares %d cookies, but only %d well-formed offsets were found", pg.number, pg.numCookiesInPage, len(pg.cookieOffsets))
+			break
+		}
+		pg.cookieOffsets = append(pg.cookieOffsets, cookieLen)
+		startOffset += 4
+		endOffset += 4
+	}
+
+	if p.Event != nil {
+		p.Event("page", map[string]interface{}{"page": pg.number, "numCookies": pg.numCookiesInPage, "cookieOffsets": pg.cookieOffsets})
+	}
+
+	// The offsets are followed by a 00000000 terminator. If it isn't there, the offsets (or the cookie count) were
+	// misread, so the cookies carved from them are probably garbage
+	if ranIntoCookie {
+		// Already warned about, as there is no room for a terminator before the first cookie
+	} else if endOffset > len(pg.rawBytes) || convertHexToUint(pg.rawBytes[startOffset:endOffset]) != 0 {
+		p.warn("Page %d: no 00000000 terminator after the %d cookie offsets, the page may be misparsed", pg.number, len(pg.cookieOffsets))
+	}
+
+	// Keep every byte before the first cookie (the page header, count, offsets, terminator, and anything after it) as
+	// it is, rather than assuming what it holds, so it can be compared across files. Without any cookies, that is
+	// everything up to the end of the terminator
+	headerEnd := endOffset
+	if len(pg.cookieOffsets) > 0 {
+		headerEnd = int(pg.cookieOffsets[0])
+	}
+	if headerEnd > len(pg.rawBytes) {
+		headerEnd = len(pg.rawBytes)
+	}
+	pg.headerRegion = pg.rawBytes[:headerEnd]
+
+	// Next, extract the raw cookies (in byte slices) from the page using the offsets from above
+	for k := 0; k < len(pg.cookieOffsets); k++ {
+		p.debugf("Loop check (Page: %d): k=%v, len()=%v (Value: %v)", pg.number-1, k, len(pg.cookieOffsets)-1, pg.cookieOffsets)
+		// For last cookie, just go from last offset to end of rawBytes; otherwise, use the offsets
+		if k == len(pg.cookieOffsets)-1 {
+			pg.records = append(pg.records, pg.rawBytes[int(pg.cookieOffsets[k]):])
+		} else {
+			pg.records = append(pg.records, pg.rawBytes[int(pg.cookieOffsets[k]):int(pg.cookieOffsets[k+1])])
+		}
+	}
+}
+
+// This function reports whether any of the cookie offsets in pg after the j-th (whose 4 bytes end at end) could be a real
+// offset: not 0, inside the page, and not before the last offset already read. Only the offsets before the first cookie
+// are looked at, as anything after that is cookie data
+func laterOffsetIsValid(pg *page, j int, end int) bool {
+	var previous uint64
+	limit := len(pg.rawBytes)
+	if len(pg.cookieOffsets) > 0 {
+		previous = pg.cookieOffsets[len(pg.cookieOffsets)-1]
+		if first := int(pg.cookieOffsets[0]); first < limit {
+			limit = first
+		}
+	}
+	for k := j + 1; k < int(pg.numCookiesInPage) && end+4 <= limit; k++ {
+		offset := convertHexToUint(reverseByteSlice(pg.rawBytes[end : end+4]))
+		if offset != 0 && offset < uint64(len(pg.rawBytes)) && offset >= previous {
+			return true
+		}
+		end += 4
+	}
+	return false
+}
+
+// This method decodes a single cookie's raw bytes, as carved from a page by extractCookies. isLast says whether the
+// cookie was the last in its page, which may run on past the cookie's declared size. The page and cookie numbers are
+// only used in debug output, warnings, and the returned ParseError (whose Offset is from the start of rawBytes)
+func (p *parser) decodeCookie(rawBytes []byte, isLast bool, pageNumber int, cookieNumber int) (Cookie, error) {
+	var aCookie Cookie
+	where := fmt.Sprintf("Cookie %d in page %d", cookieNumber, pageNumber)
+
+	// A file that was cut short (common with recovered files) leaves the last cookie incomplete. Without the fixed
+	// 56 byte header there are no offsets or timestamps to decode
+	rawLen := len(rawBytes)
+	// A declared size of 0 isn't a real cookie, but a corrupt record or padding that an offset happened to point at.
+	// Decoding it would mean trusting offsets and timestamps from whatever bytes follow
+	if rawLen >= 4 && convertHexToUint(reverseByteSlice(rawBytes[:4])) == 0 {
+		return aCookie, &ParseError{Page: pageNumber, Cookie: cookieNumber, Msg: "cookie declares a size of 0, so it is probably corrupt or padding"}
+	}
+	if rawLen < 56 {
+		return aCookie, &ParseError{Offset: rawLen, Page: pageNumber, Cookie: cookieNumber, Msg: fmt.Sprintf("cookie is incomplete (%d bytes, shorter than the 56 byte header)", rawLen)}
+	}
+
+	// Decode size of individual cookies
+	a := rawBytes[:4]
+	intA := int(convertHexToUint(reverseByteSlice(a)))
+
+	// The declared size should match the bytes carved for the cookie from the page offsets. The last cookie in a
+	// page runs to the end of the page (and in the last page, the end of the file), so it can be longer, but any
+	// other difference means the offsets are probably corrupt
+	if intA != rawLen && !(isLast && intA < rawLen) {
+		p.debugWarn("%s declares a size of %d bytes, but %d bytes were carved for it", where, intA, rawLen)
+	}
+	// If the last cookie is shorter than it says it is, the file was cut off part way through it, so its strings
+	// may be cut off too. It is rejected rather than returned with values that look complete but aren't
+	if isLast && intA > rawLen {
+		return aCookie, &ParseError{Offset: rawLen, Page: pageNumber, Cookie: cookieNumber, Msg: fmt.Sprintf("cookie is incomplete (%d of its %d bytes are present)", rawLen, intA)}
+	}
+	// Defensively trim the last cookie to its declared size, so the string scans can't run into the bytes that
+	// follow it. This is only done if the declared size still covers the fixed 56 byte header (which holds the
+	// offsets and timestamps) and everything the string offsets point to
+	if isLast && intA >= 56 && intA < rawLen && stringOffsetsWithin(rawBytes, intA) {
+		rawBytes = rawBytes[:intA]
+	}
+
+	// Decode the flags of individual cookies (see FlagText for what the bits mean)
+	b := uint32(convertHexToUint(reverseByteSlice(rawBytes[8:12])))
+
+	// Determine offsets for the other values (needed to know where to carve values from)
+	domainOffset := convertHexToUint(reverseByteSlice(rawBytes[16:20])) // 4 byte field
+	nameOffset := convertHexToUint(reverseByteSlice(rawBytes[20:24]))   // 4 byte field
+	pathOffset := convertHexToUint(reverseByteSlice(rawBytes[24:28]))   // 4 byte field
+	valueOffset := convertHexToUint(reverseByteSlice(rawBytes[28:32]))  // 4 byte field
+	if p.Event != nil {
+		p.Event("cookie", map[string]interface{}{
+			"page": pageNumber, "cookie": cookieNumber, "size": intA, "flags": b,
+			"domainOffset": domainOffset, "nameOffset": nameOffset, "pathOffset": pathOffset, "valueOffset": valueOffset,
+		})
+	}
+
+	// Carve the values from the raw cookie bytes using the above offsets
+	// Each value is null terminated and variable in length, so scanUntilNullByte grabs everything from the offset until it sees 0x00
+	// A corrupt offset can point past the end of the cookie, in which case that value is left empty and a warning recorded
+	var cookieWarnings []string
+	carve := func(offset uint64, field string) string {
+		if offset >= uint64(len(rawBytes)) {
+			warning := fmt.Sprintf("%s offset %d is outside the cookie (%d bytes), so the %s is empty", field, offset, len(rawBytes), field)
+			cookieWarnings = append(cookieWarnings, warning)
+			p.debugWarn("%s: %s", where, warning)
+			return ""
+		}
+		return string(scanUntilNullByte(rawBytes[offset:]))
+	}
+	// A deleted cookie's value offset points at the very end of the cookie, which is different from an empty value (an
+	// offset pointing at a null byte). The offset is compared against the declared size, as the last cookie in a page can
+	// run on past it
+	deleted := valueOffset == uint64(intA) && intA <= len(rawBytes)
+	name := carve(nameOffset, "name")
+	var value string
+	if !deleted {
+		value = carve(valueOffset, "value")
+		if p.DetectUTF16 && valueOffset < uint64(len(rawBytes)) {
+			if decoded, ok := decodeUTF16Value(rawBytes[valueOffset:]); ok {
+				p.debugf("%s: value looks like UTF-16, so it was decoded as UTF-16", where)
+				value = decoded
+			}
+		}
+	} else {
+		p.debugf("%s: value offset %d is the end of the cookie, so it is a deleted cookie", where, valueOffset)
+	}
+	domain, path := carve(domainOffset, "domain"), carve(pathOffset, "path")
+
+	// Now for the timestamps. These are big-endian double precision (or float64 in Go) values of Cocoa Core Data epochs
+	expiresRaw := rawBytes[40:48] // 8 byte field
+	createdRaw := rawBytes[48:56] // 8 byte field
+	expires, created := p.convertHexToCoreDataTime(expiresRaw), p.convertHexToCoreDataTime(createdRaw)
+	session := isSessionExpiry(expires)
+
+	// A timestamp read from the wrong offset decodes to a wildly wrong date, so dates outside a plausible range are
+	// flagged. The cookie is still returned, with the problem in its warnings
+	timeReasons := []string{implausibleTimeReason("last accessed", created)}
+	if !session {
+		timeReasons = append(timeReasons, implausibleTimeReason("expiry", expires))
+	}
+	for _, reason := range timeReasons {
+		if reason != "" {
+			cookieWarnings = append(cookieWarnings, reason)
+			p.debugWarn("%s: %s", where, reason)
+		}
+	}
+
+	// Build up the cookie object
+	aCookie.Raw = rawBytes
+	aCookie.Page, aCookie.Number = pageNumber, cookieNumber
+	aCookie.Size = uint64(intA)
+	aCookie.Name = name
+	aCookie.Value = value
+	aCookie.Domain = domain
+	aCookie.Path = path
+	aCookie.Flags = b
+	aCookie.Expires = expires
+	aCookie.Created = created
+	aCookie.ExpiresRaw = convertHexToCoreDataFloat(expiresRaw)
+	aCookie.CreatedRaw = convertHexToCoreDataFloat(createdRaw)
+	aCookie.Session = session
+	aCookie.Deleted = deleted
+	aCookie.Warnings = cookieWarnings
+	return aCookie, nil
+}
+
+// This function checks that the four string offsets (domain, name, path, and value) in a cookie's header all point
+// inside its first size bytes. The value offset may also be exactly size, which is how deleted cookies are marked
+func stringOffsetsWithin(rawBytes []byte, size int) bool {
+	for start := 16; start < 32; start += 4 {
+		offset := int(convertHexToUint(reverseByteSlice(rawBytes[start : start+4])))
+		if offset > size || (offset == size && start != 28) {
+			return false
+		}
+	}
+	return true
+}
+
+// This function decodes data as a null terminated UTF-16 (little-endian) string, if it looks like one. The format itself
+// uses null terminators, so this can only be a guess: the string must start with a byte order mark, or with at least
+// two characters whose high byte is 0 (as ASCII text in UTF-16 does), and must end in a 2 byte null terminator. ok is
+// false if data doesn't look like UTF-16
+func decodeUTF16Value(data []byte) (value string, ok bool) {
+	hasBOM := len(data) >= 2 && data[0] == 0xFF && data[1] == 0xFE
+	if hasBOM {
+		data = data[2:]
+	} else if len(data) < 4 || data[0] == 0 || data[1] != 0 || data[2] == 0 || data[3] != 0 {
+		return "", false
+	}
+
+	var units []uint16
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := uint16(data[i]) | uint16(data[i+1])<<8
+		if unit == 0 {
+			return string(utf16.Decode(units)), true
+		}
+		units = append(units, unit)
+	}
+	return "", false
+}
+
+// This function scan a byte slice until it finds the first instance of a null byte (0x00). It then returns a new slice
+// from the beginning of data to the byte before the first null byte
+func scanUntilNullByte(data []byte) []byte {
+	var result []byte
+	for i := 0; i < len(data); i++ {
+		if data[i] == 0 {
+			break
+		} else {
+			result = append(result, data[i])
+		}
+	}
+	return result
+}
+
+// This function takes a byte slice and reverses the order of bytes (useful for converting between little and big endian)
+func reverseByteSlice(data []byte) []byte {
+	var result []byte
+	for i := len(data) - 1; i >= 0; i-- {
+		result = append(result, data[i])
+	}
+	return result
+}
+
+// This function converts a byte slice (like [00 00 02 2b]) to its Uint64 equivalent (like 555)
+func convertHexToUint(bytes []byte) uint64 {
+	a := hex.EncodeToString(bytes)
+	b, _ := strconv.ParseUint(a, 16, 64)
+	return b
+}
+
+// This function takes a hexadecimal byte slice containing a Cocoa Core Data epoch time and returns the raw double (seconds
+// since the Core Data epoch), before it is rounded to whole seconds or converted to a UNIX time
+func convertHexToCoreDataFloat(bytes []byte) float64 {
+	a := hex.EncodeToString(reverseByteSlice(bytes))
+	b, _ := strconv.ParseUint(a, 16, 64)
+	return math.Float64frombits(b)
+}
+
+// This method takes a hexadecimal byte slice containing a Cocoa Core Data epoch time and returns the time it stands for
+func (p *parser) convertHexToCoreDataTime(bytes []byte) time.Time {
+	c := convertHexToCoreDataFloat(bytes)
+	d := int64(c)
+	// Different between UNIX and Core Data epoch is: UNIX - 978307200 = Core Data
+	// Some third-party cookie jars reuse the binary cookies layout but store UNIX timestamps, so UnixEpoch skips this
+	if p.UnixEpoch {
+		return time.Unix(d, 0)
+	}
+	e := time.Unix(d+978307200, 0)
+	return e
+}
+
+// Cookie timestamps before the first year or from the last year here are most likely misparsed
+const (
+	plausibleFirstYear = 2000
+	plausibleLastYear  = 2100
+)
+
+// This function explains why a timestamp is implausible for a cookie (before 2000 or after 2100, which usually means it was
+// read from the wrong offset), or returns "" if it looks fine
+func implausibleTimeReason(field string, t time.Time) string {
+	if t.Year() < plausibleFirstYear || t.Year() >= plausibleLastYear {
+		return fmt.Sprintf("%s date %s is implausible (outside %d to %d), so the timestamp may be misparsed", field, t.String(), plausibleFirstYear, plausibleLastYear)
+	}
+	return ""
+}
+
+// Session cookies are stored with an expiry at (or within a day of) either the Core Data or the UNIX epoch
+const sessionTolerance = 24 * time.Hour
+
+// This function checks whether an expiry time marks a session cookie, rather than a real date to expire on
+func isSessionExpiry(expires time.Time) bool {
+	coreDataEpoch := time.Unix(978307200, 0)
+	unixEpoch := time.Unix(0, 0)
+	nearCoreData := expires.Sub(coreDataEpoch) < sessionTolerance && coreDataEpoch.Sub(expires) < sessionTolerance
+	nearUnix := expires.Sub(unixEpoch) < sessionTolerance && unixEpoch.Sub(expires) < sessionTolerance
+	return nearCoreData || nearUnix
+}
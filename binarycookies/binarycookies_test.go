@@ -0,0 +1,531 @@
+package binarycookies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A testCookie describes a cookie for buildCookie to encode. Times are Core Data timestamps (seconds since 2001-01-01)
+type testCookie struct {
+	name, value, domain, path string
+	flags                     uint32
+	expires, created          float64
+}
+
+// This function encodes c as a cookie record, laid out the way Safari writes them: the 56 byte header, then the domain,
+// name, path, and value, each null terminated
+func buildCookie(c testCookie) []byte {
+	var strs []byte
+	offsets := make([]uint32, 4)
+	for i, s := range []string{c.domain, c.name, c.path, c.value} {
+		offsets[i] = uint32(56 + len(strs))
+		strs = append(append(strs, s...), 0)
+	}
+
+	record := make([]byte, 56, 56+len(strs))
+	binary.LittleEndian.PutUint32(record[0:], uint32(56+len(strs)))
+	binary.LittleEndian.PutUint32(record[8:], c.flags)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(record[16+i*4:], offset)
+	}
+	binary.LittleEndian.PutUint64(record[40:], math.Float64bits(c.expires))
+	binary.LittleEndian.PutUint64(record[48:], math.Float64bits(c.created))
+	return append(record, strs...)
+}
+
+// This function lays out cookie records as a page: the page header, the cookie count, an offset for each cookie, and the
+// 00000000 terminator, followed by the records
+func buildPage(records ...[]byte) []byte {
+	page := []byte{0x00, 0x00, 0x01, 0x00}
+	page = binary.LittleEndian.AppendUint32(page, uint32(len(records)))
+	offset := 8 + 4*len(records) + 4
+	for _, record := range records {
+		page = binary.LittleEndian.AppendUint32(page, uint32(offset))
+		offset += len(record)
+	}
+	page = append(page, 0, 0, 0, 0)
+	for _, record := range records {
+		page = append(page, record...)
+	}
+	return page
+}
+
+// This function puts pages together into a binary cookies file, with the header and the usual 8 byte footer
+func buildFile(pages ...[]byte) []byte {
+	data := []byte("cook")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(pages)))
+	for _, page := range pages {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(page)))
+	}
+	for _, page := range pages {
+		data = append(data, page...)
+	}
+	return append(data, make([]byte, 8)...)
+}
+
+// This function builds a file of at least size bytes, made of pages of 50 cookies each, for benchmarking
+func buildLargeFile(size int) []byte {
+	var pages [][]byte
+	total := 0
+	for n := 0; total < size; n++ {
+		var records [][]byte
+		for i := 0; i < 50; i++ {
+			records = append(records, buildCookie(testCookie{
+				name:    "session_id",
+				value:   "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90",
+				domain:  ".example.com",
+				path:    "/",
+				flags:   5,
+				expires: 800000000,
+				created: 700000000 + float64(n*50+i),
+			}))
+		}
+		page := buildPage(records...)
+		pages = append(pages, page)
+		total += len(page) + 4
+	}
+	return buildFile(pages...)
+}
+
+func BenchmarkParse(b *testing.B) {
+	data := buildLargeFile(1 << 20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	data := buildLargeFile(1 << 20)
+	p := &parser{Decoder: &Decoder{}}
+	var raw [][]byte
+	err := p.decode(bytes.NewReader(data), func(pg *page, _ []Cookie) error {
+		raw = append(raw, pg.records...)
+		return nil
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, record := range raw {
+			if _, err := p.decodeCookie(record, true, 1, j+1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestBuildLargeFile(t *testing.T) {
+	data := buildLargeFile(1 << 20)
+	if len(data) < 1<<20 {
+		t.Fatalf("got %d bytes, want at least %d", len(data), 1<<20)
+	}
+	cookies, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := (&Decoder{}).ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int(header.NumPages) * 50; len(cookies) != want {
+		t.Fatalf("decoded %d cookies, want %d", len(cookies), want)
+	}
+}
+
+func TestParseKeepsFileOrder(t *testing.T) {
+	var pages [][]byte
+	var want []string
+	for p := 1; p <= 3; p++ {
+		var records [][]byte
+		for c := 1; c <= p+1; c++ {
+			name := fmt.Sprintf("page%d-cookie%d", p, c)
+			// Creation times run backwards, so sorting by anything but position would give a different order
+			records = append(records, buildCookie(testCookie{name: name, value: "v", domain: "example.com", path: "/", created: float64(1000 - len(want))}))
+			want = append(want, name)
+		}
+		pages = append(pages, buildPage(records...))
+	}
+
+	cookies, err := Parse(bytes.NewReader(buildFile(pages...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range cookies {
+		got = append(got, c.Name)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got cookies in order %v, want %v", got, want)
+	}
+}
+
+func TestParseWithInfo(t *testing.T) {
+	page1 := buildPage(goodCookie, buildCookie(testCookie{name: "second", value: "2", domain: "example.org", path: "/"}))
+	page2 := buildPage(buildCookie(testCookie{name: "third", value: "3", domain: "example.net", path: "/a"}))
+	data := buildFile(page1, page2)
+	// Safari's usual footer, so it can be told apart from the zeros buildFile leaves
+	copy(data[len(data)-8:], []byte{0x07, 0x17, 0x20, 0x05, 0x00, 0x00, 0x00, 0x4b})
+
+	info, cookies, err := ParseWithInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.FileSize != len(data) || info.NumPages != 2 || info.HeaderSize != 16 || info.NumCookies != 3 || len(cookies) != 3 {
+		t.Errorf("got %d bytes, %d pages, a %d byte header and %d (%d) cookies, want %d, 2, 16 and 3", info.FileSize, info.NumPages, info.HeaderSize, info.NumCookies, len(cookies), len(data))
+	}
+	if info.Footer != "071720050000004b" {
+		t.Errorf("got footer %s, want 071720050000004b", info.Footer)
+	}
+	if len(info.Warnings) != 0 {
+		t.Errorf("got warnings %+v, want none", info.Warnings)
+	}
+
+	// The last page is read to the end of the file, so the footer is carved along with it
+	want := []PageInfo{
+		{Number: 1, Start: 16, End: 16 + uint64(len(page1)), Size: uint64(len(page1)), CarvedSize: len(page1), CookieCount: 2},
+		{Number: 2, Start: 16 + uint64(len(page1)), End: 16 + uint64(len(page1)+len(page2)), Size: uint64(len(page2)), CarvedSize: len(page2) + 8, CookieCount: 1},
+	}
+	if len(info.Pages) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(info.Pages), len(want))
+	}
+	for i, w := range want {
+		got := info.Pages[i]
+		if got.Number != w.Number || got.Start != w.Start || got.End != w.End || got.Size != w.Size || got.CarvedSize != w.CarvedSize || got.CookieCount != w.CookieCount {
+			t.Errorf("page %d: got %+v, want %+v", i+1, got, w)
+		}
+		if len(got.Cookies) != int(w.CookieCount) || got.PageHeader != "00000100" {
+			t.Errorf("page %d: got %d cookies and page header %s, want %d and 00000100", i+1, len(got.Cookies), got.PageHeader, w.CookieCount)
+		}
+	}
+	// The cookies in a page are listed with their sizes, which here are the records' lengths
+	if got := info.Pages[0].Cookies[0]; got.Offset != 20 || got.Size != uint64(len(goodCookie)) {
+		t.Errorf("page 1 cookie 1: got offset %d and size %d, want 20 and %d", got.Offset, got.Size, len(goodCookie))
+	}
+}
+
+func TestForEach(t *testing.T) {
+	var pages [][]byte
+	for p := 1; p <= 2; p++ {
+		var records [][]byte
+		for c := 1; c <= 3; c++ {
+			records = append(records, buildCookie(testCookie{name: fmt.Sprintf("page%d-cookie%d", p, c), value: "v", domain: "example.com", path: "/"}))
+		}
+		pages = append(pages, buildPage(records...))
+	}
+	data := buildFile(pages...)
+
+	t.Run("calls fn in file order", func(t *testing.T) {
+		var got []string
+		err := ForEach(bytes.NewReader(data), func(c Cookie) error {
+			got = append(got, c.Name)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "page1-cookie1,page1-cookie2,page1-cookie3,page2-cookie1,page2-cookie2,page2-cookie3"
+		if strings.Join(got, ",") != want {
+			t.Errorf("got cookies in order %v, want %s", got, want)
+		}
+	})
+
+	t.Run("stops at the first error from fn", func(t *testing.T) {
+		stop := errors.New("stop")
+		var got []string
+		err := ForEach(bytes.NewReader(data), func(c Cookie) error {
+			got = append(got, c.Name)
+			if c.Name == "page2-cookie1" {
+				return stop
+			}
+			return nil
+		})
+		if err != stop {
+			t.Errorf("got error %v, want the one fn returned", err)
+		}
+		if want := "page1-cookie1,page1-cookie2,page1-cookie3,page2-cookie1"; strings.Join(got, ",") != want {
+			t.Errorf("fn was called with %v, want %s and no more", got, want)
+		}
+	})
+
+	t.Run("reports a bad header", func(t *testing.T) {
+		called := false
+		err := ForEach(bytes.NewReader([]byte("nope")), func(Cookie) error {
+			called = true
+			return nil
+		})
+		if err == nil || called {
+			t.Errorf("got error %v and fn called %v, want an error and no calls", err, called)
+		}
+	})
+}
+
+// This function encodes c as a deleted cookie: a record with no value, whose value offset is the size of the record
+func buildTombstone(c testCookie) []byte {
+	record := buildCookie(c)
+	record = record[:len(record)-len(c.value)-1]
+	binary.LittleEndian.PutUint32(record[0:], uint32(len(record)))
+	binary.LittleEndian.PutUint32(record[28:], uint32(len(record)))
+	return record
+}
+
+func TestJar(t *testing.T) {
+	const future, past = 2000000000, 100000000
+	data := buildFile(
+		buildPage(
+			buildCookie(testCookie{name: "sid", value: "1", domain: ".Example.com", path: "/", expires: future}),
+			buildCookie(testCookie{name: "old", value: "2", domain: "example.com", path: "/", expires: past}),
+		),
+		buildPage(
+			buildCookie(testCookie{name: "sid", value: "3", domain: "other.org", path: "/"}),
+			buildCookie(testCookie{name: "pref", value: "4", domain: "sub.example.com", path: "/", expires: future}),
+		),
+	)
+	j, err := ParseJar(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := func(cookies []Cookie) string {
+		var result []string
+		for _, c := range cookies {
+			result = append(result, c.Value)
+		}
+		return strings.Join(result, ",")
+	}
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"ByDomain ignores case and a leading dot", values(j.ByDomain("example.com")), "1,2"},
+		{"ByDomain doesn't match subdomains", values(j.ByDomain("sub.example.com")), "4"},
+		{"ByDomain with no matches", values(j.ByDomain("missing.net")), ""},
+		// A Core Data timestamp of 0 decodes as a session cookie, which never counts as expired
+		{"Active skips expired cookies", values(j.Active()), "1,3,4"},
+		{"Names are sorted and unique", strings.Join(j.Names(), ","), "old,pref,sid"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// This function returns a copy of data with the little-endian uint32 at offset set to value, for corrupting fixtures
+func withUint32(data []byte, offset int, value uint32) []byte {
+	result := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(result[offset:], value)
+	return result
+}
+
+// A decodeCase is a damaged or unusual file, the cookies it should decode to (as name=value pairs, with the domain and
+// path in brackets), and text that should appear in one of the warnings ("" if there should be none)
+type decodeCase struct {
+	name    string
+	data    []byte
+	want    string
+	warning string
+}
+
+// A cookie with nothing wrong with it, for the cases below to damage
+var goodCookie = buildCookie(testCookie{name: "sid", value: "abc", domain: "example.com", path: "/"})
+
+// The cases for TestDecodeEdgeCases
+var decodeCases = []decodeCase{
+	{"intact cookie", buildFile(buildPage(goodCookie)), "sid=abc [example.com /]", ""},
+
+	// Each string offset pointing past the end of the cookie leaves just that field empty
+	{"domain offset outside the cookie", buildFile(buildPage(withUint32(goodCookie, 16, 500))), "sid=abc [ /]", "domain offset 500 is outside the cookie"},
+	{"name offset outside the cookie", buildFile(buildPage(withUint32(goodCookie, 20, 500))), "=abc [example.com /]", "name offset 500 is outside the cookie"},
+	{"path offset outside the cookie", buildFile(buildPage(withUint32(goodCookie, 24, 500))), "sid=abc [example.com ]", "path offset 500 is outside the cookie"},
+	{"value offset outside the cookie", buildFile(buildPage(withUint32(goodCookie, 28, 500))), "sid= [example.com /]", "value offset 500 is outside the cookie"},
+
+	// A record that declares a size of 0 is padding or corruption, so it is skipped and the cookies around it kept
+	{"zero size cookie in the middle of a page", buildFile(buildPage(goodCookie, withUint32(goodCookie, 0, 0), buildCookie(testCookie{name: "last", value: "x", domain: "example.com", path: "/"}))), "sid=abc [example.com /], last=x [example.com /]", "declares a size of 0"},
+
+	// A cookie count too big for the page can't be trusted, so none of that page's offsets are read
+	{"absurd cookie count", buildFile(buildPage(goodCookie), withUint32(buildPage(goodCookie), 4, 0xFFFFFFFF)), "sid=abc [example.com /]", "declares 4294967295 cookies, but its"},
+
+	// A zero offset with good ones after it is corruption, not the terminator, so only that cookie is lost
+	{"zero cookie offset followed by good ones", buildFile(withUint32(buildPage(goodCookie, buildCookie(testCookie{name: "last", value: "x", domain: "example.com", path: "/"})), 8, 0)), "last=x [example.com /]", "the offset of cookie 1 is 0, so it was skipped"},
+
+	// A count that is too high, with no terminator, would read the first cookie's bytes as offsets
+	{"cookie count too high without a terminator", buildFile(append([]byte{0x00, 0x00, 0x01, 0x00, 3, 0, 0, 0, 12, 0, 0, 0}, goodCookie...)), "sid=abc [example.com /]", "run into the first cookie"},
+}
+
+func TestDecodeEdgeCases(t *testing.T) {
+	for _, tt := range decodeCases {
+		t.Run(tt.name, func(t *testing.T) {
+			info, cookies, err := ParseWithInfo(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got, warnings []string
+			for _, w := range info.Warnings {
+				warnings = append(warnings, w.Msg)
+			}
+			for _, c := range cookies {
+				got = append(got, fmt.Sprintf("%s=%s [%s %s]", c.Name, c.Value, c.Domain, c.Path))
+				warnings = append(warnings, c.Warnings...)
+			}
+			if strings.Join(got, ", ") != tt.want {
+				t.Errorf("got cookies %q, want %q", strings.Join(got, ", "), tt.want)
+			}
+
+			all := strings.Join(warnings, "\n")
+			if tt.warning == "" && all != "" {
+				t.Errorf("got warnings %q, want none", all)
+			} else if !strings.Contains(all, tt.warning) {
+				t.Errorf("got warnings %q, want one containing %q", all, tt.warning)
+			}
+		})
+	}
+}
+
+func TestParseCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    string
+		warning string
+		err     string
+	}{
+		{"intact cookie", goodCookie, "sid=abc [example.com /]", "", ""},
+		{"bytes after the declared size", append(append([]byte{}, goodCookie...), "junk"...), "sid=abc [example.com /]", "", ""},
+		{"truncated record", goodCookie[:len(goodCookie)-3], "", "", "75 of its 78 bytes are present"},
+		{"truncated header", goodCookie[:40], "", "", "shorter than the 56 byte header"},
+		{"zero size", withUint32(goodCookie, 0, 0), "", "", "declares a size of 0"},
+		{"value offset outside the record", withUint32(goodCookie, 28, 500), "sid= [example.com /]", "value offset 500 is outside the cookie", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseCookie(tt.raw)
+			if tt.err != "" {
+				var parseErr *ParseError
+				if !errors.As(err, &parseErr) {
+					t.Fatalf("got error %v, want a *ParseError", err)
+				}
+				if !strings.Contains(parseErr.Msg, tt.err) {
+					t.Errorf("got error %q, want one containing %q", parseErr.Msg, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprintf("%s=%s [%s %s]", c.Name, c.Value, c.Domain, c.Path); got != tt.want {
+				t.Errorf("got cookie %q, want %q", got, tt.want)
+			}
+			all := strings.Join(c.Warnings, "\n")
+			if tt.warning == "" && all != "" {
+				t.Errorf("got warnings %q, want none", all)
+			} else if !strings.Contains(all, tt.warning) {
+				t.Errorf("got warnings %q, want one containing %q", all, tt.warning)
+			}
+		})
+	}
+}
+
+func TestSkippedCookieWarning(t *testing.T) {
+	first := buildCookie(testCookie{name: "first", value: "1", domain: "example.com", path: "/"})
+	data := buildFile(buildPage(first, withUint32(goodCookie, 0, 0)))
+	info, cookies, err := ParseWithInfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 1 || cookies[0].Name != "first" {
+		t.Fatalf("got %d cookies, want just first", len(cookies))
+	}
+
+	var parseErr *ParseError
+	for _, w := range info.Warnings {
+		if errors.As(w.Err, &parseErr) {
+			break
+		}
+	}
+	if parseErr == nil {
+		t.Fatalf("no warning wraps a *ParseError: %+v", info.Warnings)
+	}
+	if parseErr.Page != 1 || parseErr.Cookie != 2 {
+		t.Errorf("got cookie %d in page %d, want cookie 2 in page 1", parseErr.Cookie, parseErr.Page)
+	}
+	// The zero size record starts straight after the first cookie, and the offset is moved to be in the file
+	if want := cookies[0].Offset + len(first); parseErr.Offset != want {
+		t.Errorf("got offset %d, want %d", parseErr.Offset, want)
+	}
+}
+
+func TestDecodeUTF16Value(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		ok   bool
+	}{
+		{"ASCII text", "h\x00i\x00!\x00\x00\x00", "hi!", true},
+		{"byte order mark", "\xff\xfeh\x00\xe9\x00\x00\x00", "hé", true},
+		{"surrogate pair", "\xff\xfe\x3d\xd8\x00\xde\x00\x00", "\U0001F600", true},
+		{"plain UTF-8", "abc\x00", "", false},
+		{"one character", "a\x00\x00\x00", "", false},
+		{"no terminator", "h\x00i\x00", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := decodeUTF16Value([]byte(tt.data))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("decodeUTF16Value(%q) = %q, %v, want %q, %v", tt.data, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDetectUTF16(t *testing.T) {
+	data := buildFile(buildPage(buildCookie(testCookie{name: "sid", value: "h\x00i\x00\x00", domain: "example.com", path: "/"})))
+
+	for _, tt := range []struct {
+		detect bool
+		want   string
+	}{{false, "h"}, {true, "hi"}} {
+		cookies, err := (&Decoder{DetectUTF16: tt.detect}).Parse(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cookies) != 1 || cookies[0].Value != tt.want {
+			t.Errorf("with DetectUTF16 %v got %+v, want a value of %q", tt.detect, cookies, tt.want)
+		}
+	}
+}
+
+// The cookie count is a little-endian integer like the other fields, so counts that aren't all decimal digits in hex
+// (10 is 0x0a) or that differ between decimal and hex (16 is 0x10) must come out right
+func TestCookieCountIsHex(t *testing.T) {
+	for _, count := range []int{9, 10, 15, 16, 26} {
+		var records [][]byte
+		for i := 0; i < count; i++ {
+			records = append(records, buildCookie(testCookie{name: fmt.Sprintf("c%d", i), value: "v", domain: "example.com", path: "/"}))
+		}
+		cookies, err := Parse(bytes.NewReader(buildFile(buildPage(records...))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cookies) != count || cookies[count-1].Name != fmt.Sprintf("c%d", count-1) {
+			t.Errorf("a page of %d cookies decoded to %d", count, len(cookies))
+		}
+	}
+}
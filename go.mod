@@ -0,0 +1,3 @@
+module github.com/KittyNighthawk/binary-cookie-extractor
+
+go 1.22